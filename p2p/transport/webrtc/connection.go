@@ -8,6 +8,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	ic "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -19,7 +20,10 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
-var _ tpt.CapableConn = &connection{}
+var (
+	_ tpt.CapableConn         = &connection{}
+	_ StreamOpenerWithOptions = (*connection)(nil)
+)
 
 const maxAcceptQueueLen = 256
 
@@ -56,6 +60,8 @@ type connection struct {
 	nextStreamID atomic.Int32
 
 	acceptQueue chan dataChannel
+	// streamConfig is the configuration of the connection's streams
+	streamConfig streamConfig
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -91,7 +97,11 @@ func newConnection(
 		cancel:          cancel,
 		streams:         make(map[uint16]*stream),
 
-		acceptQueue: incomingDataChannels,
+		acceptQueue:  incomingDataChannels,
+		streamConfig: transport.streamConfig,
+	}
+	if transport.connectionSendBuffer > 0 {
+		c.streamConfig.sendBudget = newSendBudget(transport.connectionSendBuffer)
 	}
 	switch direction {
 	case network.DirInbound:
@@ -140,16 +150,42 @@ func (c *connection) IsClosed() bool {
 }
 
 func (c *connection) OpenStream(ctx context.Context) (network.MuxedStream, error) {
+	return c.OpenStreamWithOptions(ctx)
+}
+
+// OpenStreamWithOptions opens a new stream like OpenStream, using opts to configure the
+// delivery guarantees of the underlying data channel. Without any options, the stream is
+// ordered and reliable, as returned by OpenStream.
+//
+// Streams opened with WithUnordered, WithMaxRetransmits or WithMaxPacketLifeTime don't
+// provide the semantics of a go-libp2p stream: Writes still block for space on the send
+// buffer, but data may arrive out of order, or not at all. Since data is lost or reordered
+// per message, Writes should not exceed a single message of maxMessageSize. The FIN,
+// FIN_ACK and RESET control messages are subject to the same loss and reordering. A lost
+// FIN_ACK delays closing the data channel until the FIN_ACK wait times out, and the peer may
+// read EOF before all data written before CloseWrite arrived.
+func (c *connection) OpenStreamWithOptions(ctx context.Context, opts ...StreamOption) (network.MuxedStream, error) {
 	if c.IsClosed() {
 		return nil, c.closeErr
 	}
 
+	var init webrtc.DataChannelInit
+	for _, opt := range opts {
+		if err := opt(&init); err != nil {
+			return nil, err
+		}
+	}
+	if init.MaxRetransmits != nil && init.MaxPacketLifeTime != nil {
+		return nil, errors.New("only one of max retransmits and max packet lifetime can be set")
+	}
+
 	id := c.nextStreamID.Add(2) - 2
 	if id > math.MaxUint16 {
 		return nil, errors.New("exhausted stream ID space")
 	}
 	streamID := uint16(id)
-	dc, err := c.pc.CreateDataChannel("", &webrtc.DataChannelInit{ID: &streamID})
+	init.ID = &streamID
+	dc, err := c.pc.CreateDataChannel("", &init)
 	if err != nil {
 		return nil, err
 	}
@@ -158,7 +194,7 @@ func (c *connection) OpenStream(ctx context.Context) (network.MuxedStream, error
 		dc.Close()
 		return nil, fmt.Errorf("detach channel failed for stream(%d): %w", streamID, err)
 	}
-	str := newStream(dc, rwc, func() { c.removeStream(streamID) })
+	str := newStream(dc, rwc, c.streamConfig, func() { c.removeStream(streamID) })
 	if err := c.addStream(str); err != nil {
 		str.Reset()
 		return nil, fmt.Errorf("failed to add stream(%d) to connection: %w", streamID, err)
@@ -166,12 +202,60 @@ func (c *connection) OpenStream(ctx context.Context) (network.MuxedStream, error
 	return str, nil
 }
 
+// StreamOpenerWithOptions is implemented by the connections of the WebRTC transport. To open a
+// stream with options, type-assert the tpt.CapableConn returned from Dial or Accept:
+//
+//	if o, ok := conn.(libp2pwebrtc.StreamOpenerWithOptions); ok {
+//		str, err := o.OpenStreamWithOptions(ctx, libp2pwebrtc.WithUnordered())
+//	}
+type StreamOpenerWithOptions interface {
+	// OpenStreamWithOptions opens a new stream, using opts to configure the delivery
+	// guarantees of the underlying data channel.
+	OpenStreamWithOptions(ctx context.Context, opts ...StreamOption) (network.MuxedStream, error)
+}
+
+// StreamOption configures the data channel of a stream opened with OpenStreamWithOptions.
+type StreamOption func(*webrtc.DataChannelInit) error
+
+// WithUnordered allows messages on the stream to be delivered out of order.
+func WithUnordered() StreamOption {
+	return func(init *webrtc.DataChannelInit) error {
+		ordered := false
+		init.Ordered = &ordered
+		return nil
+	}
+}
+
+// WithMaxRetransmits limits the number of times a message on the stream is retransmitted
+// before it's given up on. It can't be combined with WithMaxPacketLifeTime.
+func WithMaxRetransmits(n uint16) StreamOption {
+	return func(init *webrtc.DataChannelInit) error {
+		init.MaxRetransmits = &n
+		return nil
+	}
+}
+
+// WithMaxPacketLifeTime limits the time during which a message on the stream is
+// retransmitted before it's given up on. It has millisecond precision, and can't be combined
+// with WithMaxRetransmits.
+func WithMaxPacketLifeTime(d time.Duration) StreamOption {
+	return func(init *webrtc.DataChannelInit) error {
+		ms := d.Milliseconds()
+		if ms < 0 || ms > math.MaxUint16 {
+			return fmt.Errorf("max packet lifetime must be between 0 and %d ms: %s", math.MaxUint16, d)
+		}
+		lifeTime := uint16(ms)
+		init.MaxPacketLifeTime = &lifeTime
+		return nil
+	}
+}
+
 func (c *connection) AcceptStream() (network.MuxedStream, error) {
 	select {
 	case <-c.ctx.Done():
 		return nil, c.closeErr
 	case dc := <-c.acceptQueue:
-		str := newStream(dc.channel, dc.stream, func() { c.removeStream(*dc.channel.ID()) })
+		str := newStream(dc.channel, dc.stream, c.streamConfig, func() { c.removeStream(*dc.channel.ID()) })
 		if err := c.addStream(str); err != nil {
 			str.Reset()
 			return nil, err
@@ -4,6 +4,7 @@ import (
 	"crypto"
 	"crypto/x509"
 	"errors"
+	"fmt"
 
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multibase"
@@ -28,20 +29,51 @@ func parseFingerprint(cert *x509.Certificate, algo crypto.Hash) ([]byte, error)
 	return h.Sum(nil), nil
 }
 
-func decodeRemoteFingerprint(maddr ma.Multiaddr) (*mh.DecodedMultihash, error) {
+// decodeRemoteFingerprint decodes the certificate hash of maddr, and returns it with the hash
+// function used to create it.
+func decodeRemoteFingerprint(maddr ma.Multiaddr) (*mh.DecodedMultihash, crypto.Hash, error) {
 	remoteFingerprintMultibase, err := maddr.ValueForProtocol(ma.P_CERTHASH)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	_, data, err := multibase.Decode(remoteFingerprintMultibase)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return mh.Decode(data)
+	decoded, err := mh.Decode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	hash, err := validateCertHash(decoded)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decoded, hash, nil
+}
+
+// errUnsupportedCertHash is returned for certificate hashes that don't carry a full digest of a
+// hash function that can be used in the SDP.
+var errUnsupportedCertHash = errors.New("unsupported certificate hash")
+
+// validateCertHash checks that a certificate hash uses a hash function that can be used in the
+// SDP, and that it carries a full digest of that hash function. It returns the hash function.
+func validateCertHash(decoded *mh.DecodedMultihash) (crypto.Hash, error) {
+	hash, ok := getSupportedSDPHash(decoded.Code)
+	if !ok {
+		if name, ok := mh.Codes[decoded.Code]; ok {
+			return 0, fmt.Errorf("%w: unsupported hash function %s (0x%x)", errUnsupportedCertHash, name, decoded.Code)
+		}
+		return 0, fmt.Errorf("%w: unsupported hash function 0x%x", errUnsupportedCertHash, decoded.Code)
+	}
+	if decoded.Length != hash.Size() {
+		return 0, fmt.Errorf("%w: digest length of %d bytes, expected %d bytes for %s", errUnsupportedCertHash,
+			decoded.Length, hash.Size(), mh.Codes[decoded.Code])
+	}
+	return hash, nil
 }
 
 func encodeDTLSFingerprint(fp webrtc.DTLSFingerprint) (string, error) {
-	digest, err := decodeInterspersedHexFromASCIIString(fp.Value)
+	digest, err := decodeInterspersedHexStrict(fp.Value)
 	if err != nil {
 		return "", err
 	}
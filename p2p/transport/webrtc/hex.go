@@ -9,28 +9,40 @@ package libp2pwebrtc
 import (
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 )
 
-// encodeInterspersedHex encodes a byte slice into a string of hex characters,
+const (
+	hextable      = "0123456789abcdef"
+	hextableUpper = "0123456789ABCDEF"
+)
+
+// encodeInterspersedHex encodes a byte slice into a string of lower case hex characters,
 // separating each encoded byte with a colon (':').
 //
 // Example: { 0x01, 0x02, 0x03 } -> "01:02:03"
 func encodeInterspersedHex(src []byte) string {
+	return encodeInterspersedHexWithTable(src, hextable)
+}
+
+// encodeInterspersedHexUpper encodes a byte slice like encodeInterspersedHex, but uses
+// upper case hex characters.
+//
+// Example: { 0xba, 0x78, 0x16 } -> "BA:78:16"
+func encodeInterspersedHexUpper(src []byte) string {
+	return encodeInterspersedHexWithTable(src, hextableUpper)
+}
+
+func encodeInterspersedHexWithTable(src []byte, table string) string {
 	if len(src) == 0 {
 		return ""
 	}
-	s := hex.EncodeToString(src)
-	n := len(s)
-	// Determine number of colons
-	colons := n / 2
-	if n%2 == 0 {
-		colons--
-	}
-	buffer := make([]byte, n+colons)
-
-	for i, j := 0, 0; i < n; i, j = i+2, j+3 {
-		copy(buffer[j:j+2], s[i:i+2])
-		if j+3 < len(buffer) {
+	buffer := make([]byte, len(src)*3-1)
+	for i, j := 0, 0; i < len(src); i, j = i+1, j+3 {
+		buffer[j] = table[src[i]>>4]
+		buffer[j+1] = table[src[i]&0x0f]
+		if j+2 < len(buffer) {
 			buffer[j+2] = ':'
 		}
 	}
@@ -68,3 +80,134 @@ func decodeInterspersedHexFromASCIIString(s string) ([]byte, error) {
 	}
 	return dst, nil
 }
+
+// decodeInterspersedHexStrict decodes an ASCII string of hex characters into a byte slice,
+// like decodeInterspersedHexFromASCIIString, but enforces the exact "XX:XX:XX" grammar:
+// every byte must be encoded as exactly two hex digits, and bytes must be separated
+// by a single colon, without a leading or trailing colon.
+//
+// The returned error names the offset of the offending character.
+func decodeInterspersedHexStrict(s string) ([]byte, error) {
+	n := len(s)
+	dst := make([]byte, (n+1)/3)
+	for i := 0; i < n; i++ {
+		if i%3 == 2 {
+			if s[i] != ':' {
+				return nil, fmt.Errorf("%w: expected ':' at offset %d, got %q", errUnexpectedIntersperseHexChar, i, s[i])
+			}
+			if i == n-1 {
+				return nil, fmt.Errorf("%w: trailing ':' at offset %d", errUnexpectedIntersperseHexChar, i)
+			}
+			continue
+		}
+		if i == n-1 && i%3 == 0 {
+			return nil, fmt.Errorf("incomplete byte at offset %d: %w", i, hex.ErrLength)
+		}
+		v, ok := fromHexChar(s[i])
+		if !ok {
+			return nil, fmt.Errorf("%w: expected hex digit at offset %d, got %q", errUnexpectedIntersperseHexChar, i, s[i])
+		}
+		if i%3 == 0 {
+			dst[i/3] = v << 4
+		} else {
+			dst[i/3] |= v
+		}
+	}
+	return dst, nil
+}
+
+// NewInterspersedHexReader returns a reader that decodes the colon separated hex characters
+// read from r, e.g. "01:02:03", into raw bytes. It accepts the same input as
+// decodeInterspersedHexFromASCIIString, without buffering the whole string, so the input can
+// be split up in arbitrary chunks.
+//
+// Invalid characters result in an error wrapping errUnexpectedIntersperseHexChar, input
+// ending in the middle of a byte in an error wrapping hex.ErrLength. Both name the offset of
+// the offending character.
+func NewInterspersedHexReader(r io.Reader) io.Reader {
+	return &interspersedHexReader{r: r}
+}
+
+type interspersedHexReader struct {
+	r   io.Reader
+	err error
+
+	buf        [1024]byte
+	start, end int // the unprocessed input in buf
+	// off is the offset of the next character in the input
+	off int
+	// hi is the decoded first digit of a byte, if off%3 == 1
+	hi byte
+}
+
+func (d *interspersedHexReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if d.start == d.end {
+			if d.err == io.EOF && d.off%3 == 1 {
+				d.err = fmt.Errorf("incomplete byte at offset %d: %w", d.off-1, hex.ErrLength)
+			}
+			// Don't block on reading more input if we already decoded something.
+			if d.err != nil || n > 0 {
+				break
+			}
+			d.start = 0
+			d.end, d.err = d.r.Read(d.buf[:])
+			continue
+		}
+
+		c := d.buf[d.start]
+		d.start++
+		i := d.off
+		d.off++
+		if i%3 == 2 {
+			if c != ':' {
+				d.err = fmt.Errorf("%w: expected ':' at offset %d, got %q", errUnexpectedIntersperseHexChar, i, c)
+				d.start = d.end
+				break
+			}
+			continue
+		}
+		v, ok := fromHexChar(c)
+		if !ok {
+			d.err = fmt.Errorf("%w: expected hex digit at offset %d, got %q", errUnexpectedIntersperseHexChar, i, c)
+			d.start = d.end
+			break
+		}
+		if i%3 == 0 {
+			d.hi = v << 4
+		} else {
+			p[n] = d.hi | v
+			n++
+		}
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, d.err
+}
+
+// fromHexChar converts a hex character into its value and a success flag.
+func fromHexChar(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// FormatCertHash encodes the digest of a certificate hash into the colon separated
+// hex format used for DTLS fingerprints in SDP, e.g. "ba:78:16:bf".
+func FormatCertHash(digest []byte) string {
+	return encodeInterspersedHex(digest)
+}
+
+// ParseCertHash decodes a colon separated hex string, as produced by FormatCertHash,
+// into the raw digest bytes. Both lower and mixed case input is accepted.
+func ParseCertHash(s string) ([]byte, error) {
+	return decodeInterspersedHexStrict(s)
+}
@@ -2,8 +2,10 @@ package libp2pwebrtc
 
 import (
 	"encoding/hex"
+	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/require"
 )
@@ -14,6 +16,21 @@ func TestEncodeInterspersedHex(t *testing.T) {
 	require.Equal(t, "ba:78:16:bf:8f:01:cf:ea:41:41:40:de:5d:ae:22:23:b0:03:61:a3:96:17:7a:9c:b4:10:ff:61:f2:00:15:ad", encodeInterspersedHex(b))
 }
 
+func TestEncodeInterspersedHexUpper(t *testing.T) {
+	b, err := hex.DecodeString("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	require.NoError(t, err)
+	require.Equal(t, "BA:78:16:BF:8F:01:CF:EA:41:41:40:DE:5D:AE:22:23:B0:03:61:A3:96:17:7A:9C:B4:10:FF:61:F2:00:15:AD", encodeInterspersedHexUpper(b))
+}
+
+func TestEncodeInterspersedHexUpperOneByte(t *testing.T) {
+	require.Equal(t, "0A", encodeInterspersedHexUpper([]byte{0x0a}))
+}
+
+func TestEncodeInterspersedHexUpperNilSlice(t *testing.T) {
+	require.Equal(t, "", encodeInterspersedHexUpper(nil))
+	require.Equal(t, "", encodeInterspersedHexUpper([]byte{}))
+}
+
 func BenchmarkEncodeInterspersedHex(b *testing.B) {
 	data, err := hex.DecodeString("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
 	require.NoError(b, err)
@@ -120,6 +137,16 @@ func FuzzInterpersedHex(f *testing.F) {
 	})
 }
 
+func FuzzInterspersedHexUpper(f *testing.F) {
+	f.Fuzz(func(t *testing.T, b []byte) {
+		encoded := encodeInterspersedHexUpper(b)
+		require.Equal(t, strings.ToUpper(encodeInterspersedHex(b)), encoded)
+		decoded, err := decodeInterspersedHexFromASCIIString(encoded)
+		require.NoError(t, err)
+		require.Equal(t, b, decoded)
+	})
+}
+
 func FuzzInterspersedHexASCII(f *testing.F) {
 	f.Fuzz(func(t *testing.T, s string) {
 		decoded, err := decodeInterspersedHexFromASCIIString(s)
@@ -130,3 +157,131 @@ func FuzzInterspersedHexASCII(f *testing.F) {
 		require.Equal(t, strings.ToLower(s), encoded)
 	})
 }
+
+func TestFormatParseCertHash(t *testing.T) {
+	b, err := hex.DecodeString("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	require.NoError(t, err)
+	const s = "ba:78:16:bf:8f:01:cf:ea:41:41:40:de:5d:ae:22:23:b0:03:61:a3:96:17:7a:9c:b4:10:ff:61:f2:00:15:ad"
+	require.Equal(t, s, FormatCertHash(b))
+
+	parsed, err := ParseCertHash(s)
+	require.NoError(t, err)
+	require.Equal(t, b, parsed)
+	parsed, err = ParseCertHash(strings.ToUpper(s))
+	require.NoError(t, err)
+	require.Equal(t, b, parsed)
+
+	_, err = ParseCertHash("ba:7")
+	require.Error(t, err)
+}
+
+func TestDecodeInterspersedHexStrict(t *testing.T) {
+	b, err := decodeInterspersedHexStrict("Ba:78:16:BF:8F:01:cf:ea:41:41:40:De:5d:ae:22:23:b0:03:61:a3:96:17:7a:9c:b4:10:FF:61:f2:00:15:ad")
+	require.NoError(t, err)
+	require.Equal(t, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", hex.EncodeToString(b))
+
+	b, err = decodeInterspersedHexStrict("ba")
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xba}, b)
+
+	b, err = decodeInterspersedHexStrict("")
+	require.NoError(t, err)
+	require.Empty(t, b)
+}
+
+func TestDecodeInterspersedHexStrictInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		input  string
+		offset string
+	}{
+		{name: "odd length", input: "ba:7", offset: "offset 3"},
+		{name: "single digit", input: "0", offset: "offset 0"},
+		{name: "double colon", input: "ba::78", offset: "offset 3"},
+		{name: "misplaced colon", input: "ba7:8", offset: "offset 2"},
+		{name: "leading colon", input: ":ba:78", offset: "offset 0"},
+		{name: "trailing colon", input: "ba:78:", offset: "offset 5"},
+		{name: "embedded whitespace", input: "ba: 78", offset: "offset 3"},
+		{name: "separator whitespace", input: "ba 78", offset: "offset 2"},
+		{name: "non hex digit", input: "ba:7g", offset: "offset 4"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodeInterspersedHexStrict(tc.input)
+			require.Error(t, err)
+			require.ErrorContains(t, err, tc.offset)
+		})
+	}
+}
+
+func FuzzInterspersedHexStrict(f *testing.F) {
+	f.Fuzz(func(t *testing.T, s string) {
+		decoded, err := decodeInterspersedHexStrict(s)
+		if err != nil {
+			return
+		}
+		require.Equal(t, strings.ToLower(s), encodeInterspersedHex(decoded))
+	})
+}
+
+func TestInterspersedHexReader(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"ba",
+		"Ba:78",
+		"00:",
+		"ba:78:16:bf:8f:01:cf:ea:41:41:40:de:5d:ae:22:23:b0:03:61:a3:96:17:7a:9c:b4:10:ff:61:f2:00:15:ad",
+	} {
+		expected, err := decodeInterspersedHexFromASCIIString(s)
+		require.NoError(t, err)
+		for i := 0; i <= len(s); i++ {
+			r := NewInterspersedHexReader(io.MultiReader(strings.NewReader(s[:i]), strings.NewReader(s[i:])))
+			b, err := io.ReadAll(r)
+			require.NoError(t, err, "input %q split at %d", s, i)
+			require.Equal(t, expected, b, "input %q split at %d", s, i)
+		}
+		b, err := io.ReadAll(NewInterspersedHexReader(iotest.OneByteReader(strings.NewReader(s))))
+		require.NoError(t, err)
+		require.Equal(t, expected, b)
+		require.NoError(t, iotest.TestReader(NewInterspersedHexReader(strings.NewReader(s)), expected))
+	}
+}
+
+func TestInterspersedHexReaderInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		err   error
+	}{
+		{"0", hex.ErrLength},
+		{"00:0", hex.ErrLength},
+		{"000", errUnexpectedIntersperseHexChar},
+		{"0000", errUnexpectedIntersperseHexChar},
+		{"zz", errUnexpectedIntersperseHexChar},
+		{"00:zz", errUnexpectedIntersperseHexChar},
+		{"00;11", errUnexpectedIntersperseHexChar},
+		{":00", errUnexpectedIntersperseHexChar},
+		{"00::11", errUnexpectedIntersperseHexChar},
+	} {
+		_, err := decodeInterspersedHexFromASCIIString(tc.input)
+		require.Error(t, err)
+		for i := 0; i <= len(tc.input); i++ {
+			r := NewInterspersedHexReader(io.MultiReader(strings.NewReader(tc.input[:i]), strings.NewReader(tc.input[i:])))
+			_, err := io.ReadAll(r)
+			require.ErrorIs(t, err, tc.err, "input %q split at %d", tc.input, i)
+		}
+	}
+}
+
+func FuzzInterspersedHexReader(f *testing.F) {
+	f.Fuzz(func(t *testing.T, s string, split uint) {
+		i := int(split % uint(len(s)+1))
+		r := NewInterspersedHexReader(io.MultiReader(strings.NewReader(s[:i]), strings.NewReader(s[i:])))
+		decoded, err := io.ReadAll(r)
+		expected, expectedErr := decodeInterspersedHexFromASCIIString(s)
+		if expectedErr != nil {
+			require.Error(t, err)
+			return
+		}
+		require.NoError(t, err)
+		require.Equal(t, expected, decoded)
+	})
+}
@@ -0,0 +1,115 @@
+package libp2pwebrtc
+
+import (
+	"github.com/libp2p/go-libp2p/p2p/metricshelper"
+	"github.com/libp2p/go-libp2p/p2p/transport/webrtc/pb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricNamespace = "libp2p_webrtc"
+
+var (
+	sendStateTransitionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "send_state_transitions_total",
+			Help:      "Number of transitions of stream send sides, by resulting state",
+		},
+		[]string{"state"},
+	)
+	flagsSentTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "flags_sent_total",
+			Help:      "Number of FIN and RESET flags sent on streams",
+		},
+		[]string{"flag"},
+	)
+	openSendSides = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "open_send_sides",
+			Help:      "Number of streams that can currently send data",
+		},
+	)
+	collectors = []prometheus.Collector{
+		sendStateTransitionsTotal,
+		flagsSentTotal,
+		openSendSides,
+	}
+)
+
+// MetricsTracer tracks the state of the send side of WebRTC streams.
+type MetricsTracer interface {
+	// SendSideOpened is called when a new stream is created.
+	SendSideOpened()
+	// SendSideClosed is called when the send side of a stream is closed, reset, or the stream
+	// is shut down.
+	SendSideClosed()
+	// SendStateChanged is called when the send side of a stream transitions to state.
+	SendStateChanged(state string)
+	// FlagSent is called when a FIN or a RESET flag was written on a stream.
+	FlagSent(flag pb.Message_Flag)
+}
+
+func getFlag(flag pb.Message_Flag) string {
+	var s string
+	switch flag {
+	case pb.Message_FIN:
+		s = "fin"
+	case pb.Message_RESET:
+		s = "reset"
+	default:
+		s = "unknown"
+	}
+	return s
+}
+
+type metricsTracer struct{}
+
+var _ MetricsTracer = &metricsTracer{}
+
+type metricsTracerSetting struct {
+	reg prometheus.Registerer
+}
+
+type MetricsTracerOption func(*metricsTracerSetting)
+
+func WithRegisterer(reg prometheus.Registerer) MetricsTracerOption {
+	return func(s *metricsTracerSetting) {
+		if reg != nil {
+			s.reg = reg
+		}
+	}
+}
+
+func NewMetricsTracer(opts ...MetricsTracerOption) MetricsTracer {
+	setting := &metricsTracerSetting{reg: prometheus.DefaultRegisterer}
+	for _, opt := range opts {
+		opt(setting)
+	}
+	metricshelper.RegisterCollectors(setting.reg, collectors...)
+	return &metricsTracer{}
+}
+
+func (mt *metricsTracer) SendSideOpened() {
+	openSendSides.Inc()
+}
+
+func (mt *metricsTracer) SendSideClosed() {
+	openSendSides.Dec()
+}
+
+func (mt *metricsTracer) SendStateChanged(state string) {
+	tags := metricshelper.GetStringSlice()
+	defer metricshelper.PutStringSlice(tags)
+	*tags = append(*tags, state)
+	sendStateTransitionsTotal.WithLabelValues(*tags...).Inc()
+}
+
+func (mt *metricsTracer) FlagSent(flag pb.Message_Flag) {
+	tags := metricshelper.GetStringSlice()
+	defer metricshelper.PutStringSlice(tags)
+	*tags = append(*tags, getFlag(flag))
+	flagsSentTotal.WithLabelValues(*tags...).Inc()
+}
@@ -0,0 +1,111 @@
+package libp2pwebrtc
+
+import (
+	"context"
+	"testing"
+
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	"github.com/libp2p/go-libp2p/p2p/transport/webrtc/pb"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func getCounterValue(t *testing.T, counter *prometheus.CounterVec, label string) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	require.NoError(t, counter.WithLabelValues(label).Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func getGaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	require.NoError(t, gauge.Write(m))
+	return m.GetGauge().GetValue()
+}
+
+func TestStreamMetrics(t *testing.T) {
+	config := defaultStreamConfig
+	config.metricsTracer = NewMetricsTracer(WithRegisterer(prometheus.NewRegistry()))
+
+	// The collectors are global, so only look at the difference.
+	openBefore := getGaugeValue(t, openSendSides)
+	dataSentBefore := getCounterValue(t, sendStateTransitionsTotal, "data_sent")
+	resetBefore := getCounterValue(t, sendStateTransitionsTotal, "reset")
+	finBefore := getCounterValue(t, flagsSentTotal, "fin")
+	resetFlagBefore := getCounterValue(t, flagsSentTotal, "reset")
+
+	client, _ := getDetachedDataChannels(t)
+	closedStr := newStream(client.dc, client.rwc, config, func() {})
+	client, _ = getDetachedDataChannels(t)
+	resetStr := newStream(client.dc, client.rwc, config, func() {})
+	require.Equal(t, openBefore+2, getGaugeValue(t, openSendSides))
+
+	require.NoError(t, closedStr.CloseWrite())
+	require.Equal(t, openBefore+1, getGaugeValue(t, openSendSides))
+	require.Equal(t, dataSentBefore+1, getCounterValue(t, sendStateTransitionsTotal, "data_sent"))
+	require.Equal(t, finBefore+1, getCounterValue(t, flagsSentTotal, "fin"))
+
+	require.NoError(t, resetStr.Reset())
+	require.Equal(t, openBefore, getGaugeValue(t, openSendSides))
+	require.Equal(t, resetBefore+1, getCounterValue(t, sendStateTransitionsTotal, "reset"))
+	require.Equal(t, resetFlagBefore+1, getCounterValue(t, flagsSentTotal, "reset"))
+
+	// resetting a stream after closing it only changes the state, the send side was already closed
+	require.NoError(t, closedStr.Reset())
+	require.Equal(t, openBefore, getGaugeValue(t, openSendSides))
+	require.Equal(t, resetBefore+2, getCounterValue(t, sendStateTransitionsTotal, "reset"))
+	require.Equal(t, resetFlagBefore+2, getCounterValue(t, flagsSentTotal, "reset"))
+}
+
+func TestStreamMetricsDuplicateTransition(t *testing.T) {
+	config := defaultStreamConfig
+	config.metricsTracer = NewMetricsTracer(WithRegisterer(prometheus.NewRegistry()))
+
+	dataReceivedBefore := getCounterValue(t, sendStateTransitionsTotal, "data_received")
+	client, _ := getDetachedDataChannels(t)
+	str := newStream(client.dc, client.rwc, config, func() {})
+	require.NoError(t, str.CloseWrite())
+
+	str.mx.Lock()
+	defer str.mx.Unlock()
+	// the peer acknowledges the FIN twice
+	str.processIncomingFlag(&pb.Message{Flag: pb.Message_FIN_ACK.Enum()})
+	str.processIncomingFlag(&pb.Message{Flag: pb.Message_FIN_ACK.Enum()})
+	require.Equal(t, sendStateDataReceived, str.sendState)
+	require.Equal(t, dataReceivedBefore+1, getCounterValue(t, sendStateTransitionsTotal, "data_received"))
+}
+
+func TestHandshakeStreamMetrics(t *testing.T) {
+	mt := NewMetricsTracer(WithRegisterer(prometheus.NewRegistry()))
+	tr, listeningPeer := getTransport(t, WithMetricsTracer(mt))
+	tr1, _ := getTransport(t, WithMetricsTracer(mt))
+	listener, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer listener.Close()
+
+	openBefore := getGaugeValue(t, openSendSides)
+
+	dialC := make(chan error, 1)
+	var conn tpt.CapableConn
+	go func() {
+		var err error
+		conn, err = tr1.Dial(context.Background(), listener.Multiaddr(), listeningPeer)
+		dialC <- err
+	}()
+	lconn, err := listener.Accept()
+	require.NoError(t, err)
+	defer lconn.Close()
+	require.NoError(t, <-dialC)
+	// the send sides of the handshake streams aren't tracked
+	require.Equal(t, openBefore, getGaugeValue(t, openSendSides))
+
+	str, err := conn.OpenStream(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, openBefore+1, getGaugeValue(t, openSendSides))
+	require.NoError(t, str.Reset())
+	require.Equal(t, openBefore, getGaugeValue(t, openSendSides))
+	require.NoError(t, conn.Close())
+}
@@ -0,0 +1,242 @@
+package libp2pwebrtc
+
+import "sync"
+
+// sendBudget limits the total amount of data enqueued on the data channels of all streams of
+// a connection. All streams share the same SCTP association, so without a shared limit many
+// concurrent streams can enqueue a lot more data than a single stream, increasing the latency
+// for all of them.
+//
+// Streams reserve space on the budget before writing a message. The space is reclaimed once
+// the data has been sent out, i.e. once the buffered amount of the stream's data channel drops.
+// Streams that can't reserve space wait in FIFO order, so that a single stream can't starve the
+// others. Since a stream waits again after writing a message, waiting streams take turns.
+type sendBudget struct {
+	mx sync.Mutex
+
+	max int
+	// used is the space charged to and granted to streams
+	used    int
+	streams map[*stream]*budgetEntry
+	waiting []*stream
+	// thresholdsLowered is true if the buffered amount low thresholds of all streams are lowered
+	thresholdsLowered bool
+}
+
+type budgetEntry struct {
+	// charged is the amount of data written by the stream that might still be buffered
+	charged int
+	// granted is the space reserved for the stream's next message, while it's woken up
+	granted int
+	waiting bool
+}
+
+func newSendBudget(max int) *sendBudget {
+	return &sendBudget{
+		max:     max,
+		streams: make(map[*stream]*budgetEntry),
+	}
+}
+
+func (b *sendBudget) add(s *stream) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.streams[s] = &budgetEntry{}
+	if b.thresholdsLowered {
+		s.holdLowThreshold()
+	}
+}
+
+// remove removes s from the budget, releasing all space charged to it.
+func (b *sendBudget) remove(s *stream) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	e, ok := b.streams[s]
+	if !ok {
+		return
+	}
+	b.used -= e.charged + e.granted
+	if e.waiting {
+		b.removeWaiting(s)
+	}
+	if b.thresholdsLowered {
+		s.releaseLowThreshold()
+	}
+	delete(b.streams, s)
+	b.grant()
+}
+
+// reserve reserves space for a message of at least min and at most max bytes for s.
+// It returns the reserved space, or 0 if s has to wait for space. In that case s is notified
+// with notifyWriteStateChanged once space was reserved for it.
+// After writing a message, the reservation must be committed with commit.
+func (b *sendBudget) reserve(s *stream, min, max int) int {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	e, ok := b.streams[s]
+	if !ok {
+		// The stream was already removed. Writing will fail anyway.
+		return max
+	}
+	if e.granted > 0 {
+		n := e.granted
+		e.granted = 0
+		return n
+	}
+	if e.waiting {
+		return 0
+	}
+	// don't overtake waiting streams
+	if len(b.waiting) == 0 {
+		if b.max-b.used < min {
+			b.reclaim()
+		}
+		if free := b.max - b.used; free >= min {
+			n := max
+			if n > free {
+				n = free
+			}
+			b.used += n
+			return n
+		}
+	}
+
+	e.waiting = true
+	b.waiting = append(b.waiting, s)
+	if !b.thresholdsLowered {
+		// We're only notified when the buffered amount of a stream drops below its threshold.
+		// The buffered amount of all streams might already be below their thresholds, so lower
+		// them to get notified when any of them has sent all of its data. Data that was sent
+		// before lowering the thresholds is reclaimed below.
+		b.thresholdsLowered = true
+		for m := range b.streams {
+			m.holdLowThreshold()
+		}
+		b.reclaim()
+		b.grant()
+		if e.granted > 0 {
+			n := e.granted
+			e.granted = 0
+			return n
+		}
+	}
+	return 0
+}
+
+// commit commits a reservation of reserved bytes returned from reserve, after s wrote a
+// message of size written. Unused space is released.
+func (b *sendBudget) commit(s *stream, reserved, written int) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	e, ok := b.streams[s]
+	if !ok {
+		return
+	}
+	e.charged += written
+	b.used -= reserved - written
+	if reserved > written {
+		b.grant()
+	}
+}
+
+// cancel releases the space granted to s, and removes s from the waiting streams. A write
+// cancels when it returns, so that a stream doesn't keep space reserved no writer consumes.
+func (b *sendBudget) cancel(s *stream) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	e, ok := b.streams[s]
+	if !ok || (e.granted == 0 && !e.waiting) {
+		return
+	}
+	b.used -= e.granted
+	e.granted = 0
+	if e.waiting {
+		b.removeWaiting(s)
+	}
+	// A concurrent Write on the same stream might need the space
+	s.notifyWriteStateChanged()
+	b.grant()
+}
+
+// onBufferedAmountLow is called when the buffered amount of one of the streams dropped.
+func (b *sendBudget) onBufferedAmountLow() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if len(b.waiting) == 0 {
+		return
+	}
+	b.reclaim()
+	b.grant()
+}
+
+// reclaim releases the space charged to streams for data that has been sent.
+// It needs to be called while the mutex is locked.
+func (b *sendBudget) reclaim() {
+	for s, e := range b.streams {
+		if e.charged == 0 {
+			continue
+		}
+		if buffered := int(s.dataChannel.BufferedAmount()); buffered < e.charged {
+			b.used -= e.charged - buffered
+			e.charged = buffered
+		}
+	}
+}
+
+// grant reserves space for waiting streams in FIFO order, and wakes them up. Every stream is
+// granted space for a full message, so that streams taking turns send the same amount of data,
+// even when the space is reclaimed in small parts.
+// It needs to be called while the mutex is locked.
+func (b *sendBudget) grant() {
+	for len(b.waiting) > 0 {
+		s := b.waiting[0]
+		n := s.config.maxMessageSize
+		if n > b.max {
+			n = b.max
+		}
+		if b.max-b.used < n {
+			return
+		}
+		e := b.streams[s]
+		e.granted = n
+		e.waiting = false
+		b.used += n
+		b.waiting[0] = nil
+		b.waiting = b.waiting[1:]
+		s.notifyWriteStateChanged()
+	}
+	b.restoreThresholds()
+}
+
+// removeWaiting removes s from the waiting streams.
+// It needs to be called while the mutex is locked.
+func (b *sendBudget) removeWaiting(s *stream) {
+	b.streams[s].waiting = false
+	for i, w := range b.waiting {
+		if w == s {
+			b.waiting = append(b.waiting[:i], b.waiting[i+1:]...)
+			break
+		}
+	}
+	if len(b.waiting) == 0 {
+		b.restoreThresholds()
+	}
+}
+
+// restoreThresholds restores the buffered amount low thresholds of all streams, once no
+// stream is waiting anymore.
+// It needs to be called while the mutex is locked.
+func (b *sendBudget) restoreThresholds() {
+	if !b.thresholdsLowered {
+		return
+	}
+	b.thresholdsLowered = false
+	for m := range b.streams {
+		m.releaseLowThreshold()
+	}
+}
@@ -0,0 +1,159 @@
+package libp2pwebrtc
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-msgio/pbio"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// budgetCheckingWriter records the maximum amount of data buffered on the data channels of
+// all streams, before any of them writes a message
+type budgetCheckingWriter struct {
+	pbio.Writer
+	streams     []*stream
+	maxBuffered *atomic.Uint64
+}
+
+func (w *budgetCheckingWriter) WriteMsg(msg proto.Message) error {
+	b := uint64(proto.Size(msg))
+	for _, s := range w.streams {
+		b += s.dataChannel.BufferedAmount()
+	}
+	for {
+		max := w.maxBuffered.Load()
+		if b <= max || w.maxBuffered.CompareAndSwap(max, b) {
+			break
+		}
+	}
+	return w.Writer.WriteMsg(msg)
+}
+
+func TestSendBudget(t *testing.T) {
+	const numStreams = 4
+	const budget = 3 * maxMessageSize
+
+	tr, listeningPeer := getTransport(t)
+	listener, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer listener.Close()
+	tr1, _ := getTransport(t, WithConnectionSendBuffer(budget))
+	conn, err := tr1.Dial(context.Background(), listener.Multiaddr(), listeningPeer)
+	require.NoError(t, err)
+	defer conn.Close()
+	lconn, err := listener.Accept()
+	require.NoError(t, err)
+	defer lconn.Close()
+
+	// all streams share the SCTP association of the connection
+	clients := make([]*stream, numStreams)
+	for i := range clients {
+		str, err := conn.OpenStream(context.Background())
+		require.NoError(t, err)
+		clients[i] = str.(*stream)
+	}
+	var maxBuffered atomic.Uint64
+	for _, s := range clients {
+		s.writer = &budgetCheckingWriter{Writer: s.writer, streams: clients, maxBuffered: &maxBuffered}
+	}
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	var wg sync.WaitGroup
+	// written is the amount of data written by every stream, once the first stream is done
+	written := make(chan []uint64, numStreams)
+	for _, s := range clients {
+		wg.Add(1)
+		go func(s *stream) {
+			defer wg.Done()
+			_, err := s.Write(data)
+			assert.NoError(t, err)
+			var w []uint64
+			for _, s := range clients {
+				w = append(w, s.WriteStats().BytesWritten)
+			}
+			written <- w
+			assert.NoError(t, s.CloseWrite())
+		}(s)
+	}
+	for i := 0; i < numStreams; i++ {
+		s, err := lconn.AcceptStream()
+		require.NoError(t, err)
+		wg.Add(1)
+		go func(s network.MuxedStream) {
+			defer wg.Done()
+			b, err := io.ReadAll(s)
+			assert.NoError(t, err)
+			assert.Equal(t, data, b)
+		}(s)
+	}
+	wg.Wait()
+
+	// The FIN of a stream that is done writing isn't accounted for.
+	require.LessOrEqual(t, maxBuffered.Load(), uint64(budget+numStreams*maxTotalControlMessagesSize))
+	// the streams take turns when writing, so none of them is starved
+	for _, w := range <-written {
+		require.Greater(t, w, uint64(len(data)/2))
+	}
+
+	// all reservations are released once the data was sent
+	b := clients[0].config.sendBudget
+	require.Eventually(t, func() bool {
+		b.mx.Lock()
+		defer b.mx.Unlock()
+		b.reclaim()
+		return b.used == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	b.mx.Lock()
+	require.Empty(t, b.waiting)
+	require.False(t, b.thresholdsLowered)
+	b.mx.Unlock()
+	for _, s := range clients {
+		s.thresholdMx.Lock()
+		require.Zero(t, s.lowThresholdHolds)
+		s.thresholdMx.Unlock()
+	}
+}
+
+func TestSendBudgetRemoveStream(t *testing.T) {
+	config := defaultStreamConfig
+	config.sendBudget = newSendBudget(defaultMinMessageSize)
+
+	client, _ := getDetachedDataChannels(t)
+	s := newStream(client.dc, client.rwc, config, func() {})
+	b := config.sendBudget
+	require.Equal(t, defaultMinMessageSize, b.reserve(s, defaultMinMessageSize, maxMessageSize))
+	b.commit(s, defaultMinMessageSize, defaultMinMessageSize)
+
+	// the stream doesn't get any space until the data has been sent
+	// The peer doesn't read, so the data stays buffered on the data channel once its receive
+	// window is full.
+	for i := 0; i < 2<<10; i++ {
+		_, err := s.dataChannel.Write(make([]byte, 1<<10))
+		require.NoError(t, err)
+	}
+	require.Greater(t, s.dataChannel.BufferedAmount(), uint64(defaultMinMessageSize))
+	client, _ = getDetachedDataChannels(t)
+	other := newStream(client.dc, client.rwc, config, func() {})
+	require.Zero(t, b.reserve(other, defaultMinMessageSize, maxMessageSize))
+
+	// removing the stream releases its space, and grants it to the waiting stream
+	version := other.loadWriteStateVersion()
+	b.remove(s)
+	require.NotEqual(t, version, other.loadWriteStateVersion(), "expected the waiting stream to be notified")
+	require.Equal(t, defaultMinMessageSize, b.reserve(other, defaultMinMessageSize, maxMessageSize))
+	b.cancel(other)
+	b.commit(other, defaultMinMessageSize, 0)
+	require.Zero(t, b.used)
+}
@@ -2,6 +2,8 @@ package libp2pwebrtc
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -17,13 +19,17 @@ import (
 const (
 	// maxMessageSize is the maximum message size of the Protobuf message we send / receive.
 	maxMessageSize = 16384
-	// maxSendBuffer is the maximum data we enqueue on the underlying data channel for writes.
-	// The underlying SCTP layer has an unbounded buffer for writes. We limit the amount enqueued
-	// per stream is limited to avoid a single stream monopolizing the entire connection.
-	maxSendBuffer = 2 * maxMessageSize
-	// sendBufferLowThreshold is the threshold below which we write more data on the underlying
-	// data channel. We want a notification as soon as we can write 1 full sized message.
-	sendBufferLowThreshold = maxSendBuffer - maxMessageSize
+	// minPayloadSize is the minimum amount of data a message must be able to carry after the
+	// protobuf and varint overhead.
+	minPayloadSize = 1
+	// defaultMaxSendBuffer is the default for the maximum data we enqueue on the underlying
+	// data channel for writes. The underlying SCTP layer has an unbounded buffer for writes.
+	// We limit the amount enqueued per stream to avoid a single stream monopolizing the
+	// entire connection.
+	defaultMaxSendBuffer = 2 * maxMessageSize
+	// defaultMinMessageSize is the default for the minimum amount of space we need on the send
+	// buffer before putting a new message on the data channel.
+	defaultMinMessageSize = 1 << 10
 	// maxTotalControlMessagesSize is the maximum total size of all control messages we will
 	// write on this stream.
 	// 4 control messages of size 10 bytes + 10 bytes buffer. This number doesn't need to be
@@ -45,6 +51,104 @@ const (
 	maxFINACKWait = 10 * time.Second
 )
 
+// streamConfig holds the stream settings that are configurable on the transport.
+type streamConfig struct {
+	// maxMessageSize is the maximum size of the messages we send, including the overhead.
+	// It can't be larger than maxMessageSize, the maximum size of a message the peer accepts.
+	maxMessageSize int
+	// maxSendBuffer is the maximum data we enqueue on the underlying data channel for writes.
+	maxSendBuffer int
+	// minMessageSize is the minimum space we need on the send buffer to put a new message on
+	// the data channel. If we have less space, we wait until more space opens up.
+	minMessageSize int
+	// sendBufferLowThreshold is the threshold below which we write more data on the underlying
+	// data channel. Writers blocked on a full send buffer are woken up when the buffered
+	// amount drops below this threshold.
+	sendBufferLowThreshold int
+	// metricsTracer tracks the send state of the stream. It's nil if metrics are disabled.
+	metricsTracer MetricsTracer
+	// sendBudget is the send budget shared by all streams of a connection. It's nil if the
+	// amount of data enqueued by a connection isn't limited.
+	sendBudget *sendBudget
+	// anomalyHandler receives the anomalies detected on the stream. If it's nil, they're
+	// logged.
+	anomalyHandler func(StreamAnomaly)
+}
+
+// StreamAnomaly is an invariant violation detected on a stream. Anomalies point to a bug, either
+// in this package or in the underlying data channel implementation.
+type StreamAnomaly struct {
+	// Message describes the anomaly.
+	Message string
+	// StreamID is the id of the stream's data channel.
+	StreamID uint16
+	// MaxSendBuffer is the maximum amount of data the stream enqueues on the data channel.
+	MaxSendBuffer int
+	// Buffered is the amount of data buffered on the data channel.
+	Buffered uint64
+}
+
+var defaultStreamConfig = streamConfig{
+	maxMessageSize:         maxMessageSize,
+	maxSendBuffer:          defaultMaxSendBuffer,
+	minMessageSize:         defaultMinMessageSize,
+	sendBufferLowThreshold: defaultSendBufferLowThreshold(maxMessageSize, defaultMaxSendBuffer, defaultMinMessageSize),
+}
+
+// defaultSendBufferLowThreshold returns the default threshold for the buffered amount below
+// which we write more data. We want a notification as soon as we can write 1 full sized message.
+// For send buffers smaller than a full sized message we want a notification as soon as we
+// can write a message of minMessageSize.
+func defaultSendBufferLowThreshold(messageSize, maxSendBuffer, minMessageSize int) int {
+	if maxSendBuffer < messageSize {
+		return maxSendBuffer - minMessageSize
+	}
+	return maxSendBuffer - messageSize
+}
+
+// errMessageSizeTooSmall is returned from writes on a stream if the configured message sizes
+// don't leave any space for data after the message overhead.
+var errMessageSizeTooSmall = errors.New("message size too small for the message overhead")
+
+// checkMessageSizes checks that every message we send can carry at least minPayloadSize bytes
+// of data after the message overhead. Otherwise, we'd compute negative payload lengths.
+func (c *streamConfig) checkMessageSizes() error {
+	if c.maxMessageSize < protoOverhead+varintOverhead+minPayloadSize {
+		return fmt.Errorf("%w: max message size (%d) must be at least %d bytes",
+			errMessageSizeTooSmall, c.maxMessageSize, protoOverhead+varintOverhead+minPayloadSize)
+	}
+	if c.minMessageSize < protoOverhead+varintOverhead+minPayloadSize {
+		return fmt.Errorf("%w: min message size (%d) must be at least %d bytes",
+			errMessageSizeTooSmall, c.minMessageSize, protoOverhead+varintOverhead+minPayloadSize)
+	}
+	return nil
+}
+
+// validate checks that the settings are consistent with each other.
+func (c *streamConfig) validate() error {
+	if err := c.checkMessageSizes(); err != nil {
+		return err
+	}
+	if c.maxMessageSize > maxMessageSize {
+		return fmt.Errorf("max message size (%d) must not exceed %d bytes", c.maxMessageSize, maxMessageSize)
+	}
+	if c.minMessageSize > c.maxMessageSize {
+		return fmt.Errorf("min message size (%d) must not exceed the max message size (%d)",
+			c.minMessageSize, c.maxMessageSize)
+	}
+	if c.minMessageSize > c.maxSendBuffer {
+		return fmt.Errorf("min message size (%d) must not exceed the stream write buffer (%d)",
+			c.minMessageSize, c.maxSendBuffer)
+	}
+	// Writers waiting for space only get woken up when the buffered amount drops below the
+	// threshold. At that point there must be enough space to write a message.
+	if c.sendBufferLowThreshold > c.maxSendBuffer-c.minMessageSize {
+		return fmt.Errorf("send buffer low threshold (%d) must not exceed the stream write buffer (%d) minus the min message size (%d)",
+			c.sendBufferLowThreshold, c.maxSendBuffer, c.minMessageSize)
+	}
+	return nil
+}
+
 type receiveState uint8
 
 const (
@@ -53,6 +157,65 @@ const (
 	receiveStateReset                  // either by calling CloseRead locally, or by receiving
 )
 
+// StreamResetError is the error returned from Read when the peer reset the stream, and from
+// ResetError after the stream was reset.
+// It wraps network.ErrReset.
+type StreamResetError struct {
+	// ErrorCode is the error code sent by the peer, or by us for local resets. It's 0 if no
+	// error code was sent.
+	ErrorCode uint32
+	// Remote is true if the stream was reset by the peer.
+	Remote bool
+	// Cause is what triggered the reset.
+	Cause ResetCause
+}
+
+func (e *StreamResetError) Error() string {
+	switch e.Cause {
+	case ResetCauseStopSending:
+		return "stream reset by remote: peer stopped reading"
+	case ResetCauseDataChannelClosed:
+		return "stream reset by remote: data channel closed without closing the stream"
+	}
+	if e.Remote {
+		return fmt.Sprintf("stream reset by remote (error code: %d)", e.ErrorCode)
+	}
+	return fmt.Sprintf("stream reset (error code: %d)", e.ErrorCode)
+}
+
+func (e *StreamResetError) Unwrap() error { return network.ErrReset }
+
+// ResetCause is the cause of a stream reset.
+type ResetCause uint8
+
+const (
+	// ResetCauseLocal is a reset by calling Reset or ResetWithError on the stream.
+	ResetCauseLocal ResetCause = iota + 1
+	// ResetCauseRemoteReset is a reset by the peer, sending a RESET.
+	ResetCauseRemoteReset
+	// ResetCauseStopSending is a reset of the send side, after the peer sent a STOP_SENDING
+	// since it stopped reading.
+	ResetCauseStopSending
+	// ResetCauseDataChannelClosed is a reset by the peer closing the data channel, without
+	// sending a FIN first.
+	ResetCauseDataChannelClosed
+)
+
+func (c ResetCause) String() string {
+	switch c {
+	case ResetCauseLocal:
+		return "local"
+	case ResetCauseRemoteReset:
+		return "remote_reset"
+	case ResetCauseStopSending:
+		return "stop_sending"
+	case ResetCauseDataChannelClosed:
+		return "data_channel_closed"
+	default:
+		return "unknown"
+	}
+}
+
 type sendState uint8
 
 const (
@@ -62,6 +225,21 @@ const (
 	sendStateReset
 )
 
+func (s sendState) String() string {
+	switch s {
+	case sendStateSending:
+		return "sending"
+	case sendStateDataSent:
+		return "data_sent"
+	case sendStateDataReceived:
+		return "data_received"
+	case sendStateReset:
+		return "reset"
+	default:
+		return "unknown"
+	}
+}
+
 // Package pion detached data channel into a net.Conn
 // and then a network.MuxedStream
 type stream struct {
@@ -71,17 +249,57 @@ type stream struct {
 	// But we may need to read from reader for control messages from a different goroutine.
 	readerMx sync.Mutex
 	reader   pbio.Reader
+	// readDeadline is the deadline set with SetReadDeadline
+	readDeadline time.Time
+	// readingFINACK is set while CloseWriteWithTimeout reads from the data channel with its own
+	// read deadline
+	readingFINACK bool
+	// readers is the number of Read calls in progress. CloseWriteWithTimeout gives way to them.
+	readers int
+	// readerDone is closed once neither Read nor CloseWriteWithTimeout read from the data
+	// channel anymore, for CloseWriteWithTimeout waiting to read the FIN_ACK itself
+	readerDone chan struct{}
 
 	// this buffer is limited up to a single message. Reason we need it
 	// is because a reader might read a message midway, and so we need a
 	// wait to buffer that for as long as the remaining part is not (yet) read
 	nextMessage  *pb.Message
 	receiveState receiveState
-
-	writer            pbio.Writer // concurrent writes prevented by mx
+	// remoteResetErr is the error returned from Read after the peer reset the stream
+	remoteResetErr error
+	// resetErr is the reason for the first reset of either side of the stream
+	resetErr *StreamResetError
+
+	writer        pbio.Writer // concurrent writes prevented by mx
+	config        streamConfig
+	sendState     sendState
+	writeDeadline time.Time
+	// writeDeadlineExpiredOnSet is true if the write deadline was already expired by more than
+	// expiredWriteDeadlineSlack when it was set
+	writeDeadlineExpiredOnSet bool
+	writeStats                StreamWriteStats
+	// writeMessagesDone is set while a WriteMessages call is in progress, and closed when it
+	// returns
+	writeMessagesDone chan struct{}
+	// writeQueue are the writes waiting for space on the send buffer, in FIFO order
+	writeQueue []*queuedWrite
+
+	// writeStateMx guards writeStateVersion and writeStateChanged. It's separate from mx, since
+	// the write state also changes in the data channel's callbacks and on the send budget.
+	writeStateMx sync.Mutex
+	// writeStateVersion is incremented on every change of the write state. Waiters load it
+	// before checking the write state, and only wait if it didn't change since.
+	writeStateVersion uint64
+	// writeStateChanged is closed on the next change of the write state. It's only created
+	// once a goroutine waits for a change.
 	writeStateChanged chan struct{}
-	sendState         sendState
-	writeDeadline     time.Time
+
+	// thresholdMx guards lowThresholdHolds. It's separate from mx, since the send budget
+	// lowers the thresholds of all streams of a connection.
+	thresholdMx sync.Mutex
+	// lowThresholdHolds is the number of Flush calls and send budgets waiting for the send
+	// buffer to drain. While it's non-zero, the buffered amount low threshold is 0.
+	lowThresholdHolds int
 
 	controlMessageReaderOnce sync.Once
 	// controlMessageReaderEndTime is the end time for reading FIN_ACK from the control
@@ -98,28 +316,41 @@ type stream struct {
 	closeForShutdownErr error
 }
 
-var _ network.MuxedStream = &stream{}
+var (
+	_ network.MuxedStream = &stream{}
+	_ io.ReaderFrom       = &stream{}
+	_ io.StringWriter     = &stream{}
+)
 
 func newStream(
 	channel *webrtc.DataChannel,
 	rwc datachannel.ReadWriteCloser,
+	config streamConfig,
 	onDone func(),
 ) *stream {
 	s := &stream{
-		reader:            pbio.NewDelimitedReader(rwc, maxMessageSize),
-		writer:            pbio.NewDelimitedWriter(rwc),
-		writeStateChanged: make(chan struct{}, 1),
-		id:                *channel.ID(),
-		dataChannel:       rwc.(*datachannel.DataChannel),
-		onDone:            onDone,
+		reader:      pbio.NewDelimitedReader(rwc, maxMessageSize),
+		writer:      pbio.NewDelimitedWriter(rwc),
+		config:      config,
+		id:          *channel.ID(),
+		dataChannel: rwc.(*datachannel.DataChannel),
+		onDone:      onDone,
 	}
 	// released when the controlMessageReader goroutine exits
 	s.controlMessageReaderDone.Add(1)
-	s.dataChannel.SetBufferedAmountLowThreshold(sendBufferLowThreshold)
+	s.dataChannel.SetBufferedAmountLowThreshold(uint64(config.sendBufferLowThreshold))
 	s.dataChannel.OnBufferedAmountLow(func() {
 		s.notifyWriteStateChanged()
-
+		if s.config.sendBudget != nil {
+			s.config.sendBudget.onBufferedAmountLow()
+		}
 	})
+	if s.config.metricsTracer != nil {
+		s.config.metricsTracer.SendSideOpened()
+	}
+	if s.config.sendBudget != nil {
+		s.config.sendBudget.add(s)
+	}
 	return s
 }
 
@@ -152,6 +383,12 @@ func (s *stream) Close() error {
 }
 
 func (s *stream) Reset() error {
+	return s.ResetWithError(0)
+}
+
+// ResetWithError resets the stream like Reset, and sends errCode to the peer. The peer's Read
+// calls return a StreamResetError carrying the error code.
+func (s *stream) ResetWithError(errCode uint32) error {
 	s.mx.Lock()
 	isClosed := s.closeForShutdownErr != nil
 	s.mx.Unlock()
@@ -160,7 +397,7 @@ func (s *stream) Reset() error {
 	}
 
 	defer s.cleanup()
-	cancelWriteErr := s.cancelWrite()
+	cancelWriteErr := s.cancelWrite(errCode)
 	closeReadErr := s.CloseRead()
 	s.setDataChannelReadDeadline(time.Now().Add(-1 * time.Hour))
 	return errors.Join(closeReadErr, cancelWriteErr)
@@ -172,10 +409,15 @@ func (s *stream) closeForShutdown(closeErr error) {
 	s.mx.Lock()
 	defer s.mx.Unlock()
 
+	if s.config.metricsTracer != nil && s.closeForShutdownErr == nil && s.sendState == sendStateSending {
+		s.config.metricsTracer.SendSideClosed()
+	}
 	s.closeForShutdownErr = closeErr
 	s.notifyWriteStateChanged()
 }
 
+// SetDeadline sets both the read and the write deadline. Blocked Read and Write calls return
+// os.ErrDeadlineExceeded once t has passed. A zero t clears the deadlines.
 func (s *stream) SetDeadline(t time.Time) error {
 	_ = s.SetReadDeadline(t)
 	return s.SetWriteDeadline(t)
@@ -183,21 +425,22 @@ func (s *stream) SetDeadline(t time.Time) error {
 
 // processIncomingFlag process the flag on an incoming message
 // It needs to be called while the mutex is locked.
-func (s *stream) processIncomingFlag(flag *pb.Message_Flag) {
-	if flag == nil {
+func (s *stream) processIncomingFlag(msg *pb.Message) {
+	if msg.Flag == nil {
 		return
 	}
 
-	switch *flag {
+	switch msg.GetFlag() {
 	case pb.Message_STOP_SENDING:
 		// We must process STOP_SENDING after sending a FIN(sendStateDataSent). Remote peer
 		// may not send a FIN_ACK once it has sent a STOP_SENDING
 		if s.sendState == sendStateSending || s.sendState == sendStateDataSent {
-			s.sendState = sendStateReset
+			s.setSendState(sendStateReset)
+			s.setResetErr(&StreamResetError{Remote: true, Cause: ResetCauseStopSending})
+			s.notifyWriteStateChanged()
 		}
-		s.notifyWriteStateChanged()
 	case pb.Message_FIN_ACK:
-		s.sendState = sendStateDataReceived
+		s.setSendState(sendStateDataReceived)
 		s.notifyWriteStateChanged()
 	case pb.Message_FIN:
 		if s.receiveState == receiveStateReceiving {
@@ -210,13 +453,37 @@ func (s *stream) processIncomingFlag(flag *pb.Message_Flag) {
 		}
 		s.spawnControlMessageReader()
 	case pb.Message_RESET:
+		resetErr := &StreamResetError{ErrorCode: msg.GetErrorCode(), Remote: true, Cause: ResetCauseRemoteReset}
 		if s.receiveState == receiveStateReceiving {
 			s.receiveState = receiveStateReset
+			s.remoteResetErr = resetErr
 		}
+		s.setResetErr(resetErr)
 		s.spawnControlMessageReader()
 	}
 }
 
+// ResetError returns the reason for the reset of the stream, as a *StreamResetError. It's nil
+// if neither side of the stream was reset. If both sides were reset, it's the reason for the
+// first reset. It's meant for diagnostics, Read and Write keep returning their usual errors.
+func (s *stream) ResetError() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.resetErr == nil {
+		return nil
+	}
+	return s.resetErr
+}
+
+// setResetErr records err as the reason for the reset of the stream, unless it was reset
+// before.
+// It needs to be called while the mutex is locked.
+func (s *stream) setResetErr(err *StreamResetError) {
+	if s.resetErr == nil {
+		s.resetErr = err
+	}
+}
+
 // spawnControlMessageReader is used for processing control messages after the reader is closed.
 func (s *stream) spawnControlMessageReader() {
 	s.controlMessageReaderOnce.Do(func() {
@@ -248,7 +515,7 @@ func (s *stream) spawnControlMessageReader() {
 			s.readerMx.Unlock()
 
 			if s.nextMessage != nil {
-				s.processIncomingFlag(s.nextMessage.Flag)
+				s.processIncomingFlag(s.nextMessage)
 				s.nextMessage = nil
 			}
 			for s.closeForShutdownErr == nil &&
@@ -269,7 +536,7 @@ func (s *stream) spawnControlMessageReader() {
 					}
 					return
 				}
-				s.processIncomingFlag(msg.Flag)
+				s.processIncomingFlag(&msg)
 			}
 		}()
 	})
@@ -281,6 +548,9 @@ func (s *stream) cleanup() {
 	// memory we allocated for this stream.
 	s.dataChannel.OnBufferedAmountLow(nil)
 	s.dataChannel.Close()
+	if s.config.sendBudget != nil {
+		s.config.sendBudget.remove(s)
+	}
 	if s.onDone != nil {
 		s.onDone()
 	}
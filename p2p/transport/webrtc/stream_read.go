@@ -1,7 +1,9 @@
 package libp2pwebrtc
 
 import (
+	"errors"
 	"io"
+	"os"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
@@ -9,9 +11,29 @@ import (
 )
 
 func (s *stream) Read(b []byte) (int, error) {
+	s.mx.Lock()
+	s.readers++
+	// interrupt CloseWriteWithTimeout reading the FIN_ACK, so that this Read doesn't have to wait
+	// for it
+	if s.readingFINACK {
+		s.setDataChannelReadDeadline(time.Now().Add(-1 * time.Hour))
+	}
+	s.mx.Unlock()
+
 	s.readerMx.Lock()
-	defer s.readerMx.Unlock()
+	n, err := s.read(b)
+	s.readerMx.Unlock()
+
+	s.mx.Lock()
+	s.readers--
+	s.notifyReaderDone()
+	s.mx.Unlock()
+	return n, err
+}
 
+// read reads from the stream.
+// It needs to be called while readerMx is locked.
+func (s *stream) read(b []byte) (int, error) {
 	s.mx.Lock()
 	defer s.mx.Unlock()
 
@@ -22,7 +44,7 @@ func (s *stream) Read(b []byte) (int, error) {
 	case receiveStateDataRead:
 		return 0, io.EOF
 	case receiveStateReset:
-		return 0, network.ErrReset
+		return 0, s.receiveResetErr()
 	}
 
 	if len(b) == 0 {
@@ -52,10 +74,11 @@ func (s *stream) Read(b []byte) (int, error) {
 					// datachannel. For these implementations a stream reset will be observed as an
 					// abrupt closing of the datachannel.
 					s.receiveState = receiveStateReset
+					s.setResetErr(&StreamResetError{Remote: true, Cause: ResetCauseDataChannelClosed})
 					return 0, network.ErrReset
 				}
 				if s.receiveState == receiveStateReset {
-					return 0, network.ErrReset
+					return 0, s.receiveResetErr()
 				}
 				if s.receiveState == receiveStateDataRead {
 					return 0, io.EOF
@@ -73,7 +96,7 @@ func (s *stream) Read(b []byte) (int, error) {
 		}
 
 		// process flags on the message after reading all the data
-		s.processIncomingFlag(s.nextMessage.Flag)
+		s.processIncomingFlag(s.nextMessage)
 		s.nextMessage = nil
 		if s.closeForShutdownErr != nil {
 			return read, s.closeForShutdownErr
@@ -82,20 +105,93 @@ func (s *stream) Read(b []byte) (int, error) {
 		case receiveStateDataRead:
 			return read, io.EOF
 		case receiveStateReset:
-			return read, network.ErrReset
+			return read, s.receiveResetErr()
 		}
 	}
 }
 
+// receiveResetErr returns the error for Read calls after the receive side of the stream is reset.
+// It needs to be called while the mutex is locked.
+func (s *stream) receiveResetErr() error {
+	if s.remoteResetErr != nil {
+		return s.remoteResetErr
+	}
+	return network.ErrReset
+}
+
 func (s *stream) SetReadDeadline(t time.Time) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	if s.receiveState == receiveStateReceiving {
+	s.readDeadline = t
+	// The deadline is set once CloseWriteWithTimeout is done reading.
+	if s.receiveState == receiveStateReceiving && !s.readingFINACK {
 		s.setDataChannelReadDeadline(t)
 	}
 	return nil
 }
 
+// readFINACK reads the next message from the data channel, waiting until deadline at most, for
+// CloseWriteWithTimeout to get the FIN_ACK while nobody else reads from the stream. A Read called
+// in the meantime interrupts it. Flags are processed right away. A message carrying data is kept for the next Read, which processes its
+// flag after the data was read.
+// It returns os.ErrDeadlineExceeded once deadline is reached.
+// It needs to be called while the mutex and readerMx are locked. It returns with the mutex
+// locked, and readerMx unlocked.
+func (s *stream) readFINACK(deadline time.Time) error {
+	s.readingFINACK = true
+	s.setDataChannelReadDeadline(deadline)
+	s.mx.Unlock()
+	var msg pb.Message
+	err := s.reader.ReadMsg(&msg)
+	s.mx.Lock()
+	s.readingFINACK = false
+	if s.receiveState == receiveStateReceiving {
+		s.setDataChannelReadDeadline(s.readDeadline)
+	}
+	s.readerMx.Unlock()
+	s.notifyReaderDone()
+
+	if err != nil {
+		if s.closeForShutdownErr != nil {
+			return s.closeForShutdownErr
+		}
+		// pion/sctp can return deadline exceeded errors for cancelled deadlines, see
+		// controlMessageReader
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if !time.Now().Before(deadline) {
+				return os.ErrDeadlineExceeded
+			}
+			return nil
+		}
+		if err == io.EOF {
+			// see Read
+			if s.receiveState == receiveStateReceiving {
+				s.receiveState = receiveStateReset
+				s.setResetErr(&StreamResetError{Remote: true, Cause: ResetCauseDataChannelClosed})
+				return network.ErrReset
+			}
+			return nil
+		}
+		return err
+	}
+	if len(msg.Message) > 0 {
+		s.nextMessage = &msg
+		return nil
+	}
+	s.processIncomingFlag(&msg)
+	return nil
+}
+
+// notifyReaderDone wakes up CloseWriteWithTimeout waiting for a concurrent Read to return, once
+// no Read is in progress anymore.
+// It needs to be called while the mutex is locked.
+func (s *stream) notifyReaderDone() {
+	if s.readers == 0 && s.readerDone != nil {
+		close(s.readerDone)
+		s.readerDone = nil
+	}
+}
+
 func (s *stream) setDataChannelReadDeadline(t time.Time) error {
 	return s.dataChannel.SetReadDeadline(t)
 }
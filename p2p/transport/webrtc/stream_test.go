@@ -1,10 +1,17 @@
 package libp2pwebrtc
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
+	mrand "math/rand"
 	"os"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -14,10 +21,12 @@ import (
 
 	"github.com/libp2p/go-libp2p/core/network"
 
+	logging "github.com/ipfs/go-log/v2"
 	"github.com/pion/datachannel"
 	"github.com/pion/webrtc/v3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 type detachedChan struct {
@@ -25,7 +34,7 @@ type detachedChan struct {
 	dc  *webrtc.DataChannel
 }
 
-func getDetachedDataChannels(t *testing.T) (detachedChan, detachedChan) {
+func getDetachedDataChannels(t testing.TB) (detachedChan, detachedChan) {
 	s := webrtc.SettingEngine{}
 	s.SetIncludeLoopbackCandidate(true)
 	s.DetachDataChannels()
@@ -102,8 +111,8 @@ func TestStreamSimpleReadWriteClose(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	var clientDone, serverDone atomic.Bool
-	clientStr := newStream(client.dc, client.rwc, func() { clientDone.Store(true) })
-	serverStr := newStream(server.dc, server.rwc, func() { serverDone.Store(true) })
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() { clientDone.Store(true) })
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() { serverDone.Store(true) })
 
 	// send a foobar from the client
 	n, err := clientStr.Write([]byte("foobar"))
@@ -148,8 +157,8 @@ func TestStreamSimpleReadWriteClose(t *testing.T) {
 func TestStreamPartialReads(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
 
 	_, err := serverStr.Write([]byte("foobar"))
 	require.NoError(t, err)
@@ -171,8 +180,8 @@ func TestStreamPartialReads(t *testing.T) {
 func TestStreamSkipEmptyFrames(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
 
 	for i := 0; i < 10; i++ {
 		require.NoError(t, serverStr.writer.WriteMsg(&pb.Message{}))
@@ -206,7 +215,7 @@ func TestStreamSkipEmptyFrames(t *testing.T) {
 func TestStreamReadReturnsOnClose(t *testing.T) {
 	client, _ := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
 	errChan := make(chan error, 1)
 	go func() {
 		_, err := clientStr.Read([]byte{0})
@@ -229,8 +238,8 @@ func TestStreamResets(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	var clientDone, serverDone atomic.Bool
-	clientStr := newStream(client.dc, client.rwc, func() { clientDone.Store(true) })
-	serverStr := newStream(server.dc, server.rwc, func() { serverDone.Store(true) })
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() { clientDone.Store(true) })
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() { serverDone.Store(true) })
 
 	// send a foobar from the client
 	_, err := clientStr.Write([]byte("foobar"))
@@ -265,8 +274,8 @@ func TestStreamResets(t *testing.T) {
 func TestStreamReadDeadlineAsync(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
 
 	timeout := 100 * time.Millisecond
 	if os.Getenv("CI") != "" {
@@ -296,8 +305,8 @@ func TestStreamReadDeadlineAsync(t *testing.T) {
 func TestStreamWriteDeadlineAsync(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
 	_ = serverStr
 
 	b := make([]byte, 1024)
@@ -323,11 +332,138 @@ func TestStreamWriteDeadlineAsync(t *testing.T) {
 	require.LessOrEqual(t, took, timeout*3/2)
 }
 
+func TestStreamSetDeadline(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	timeout := 100 * time.Millisecond
+	if os.Getenv("CI") != "" {
+		timeout *= 5
+	}
+
+	// the server doesn't read, so the write blocks once the receive window is full
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := clientStr.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := clientStr.Write(make([]byte, 4<<20))
+		writeErr <- err
+	}()
+	require.Eventually(t, func() bool {
+		return clientStr.WriteStats().BytesWritten > 1<<20 && clientStr.BufferedAmount() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the deadline unblocks both the reader and the writer
+	start := time.Now()
+	require.NoError(t, clientStr.SetDeadline(start.Add(timeout)))
+	for _, errCh := range []chan error{readErr, writeErr} {
+		select {
+		case err := <-errCh:
+			require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the deadline to unblock the call")
+		}
+	}
+	require.GreaterOrEqual(t, time.Since(start), timeout)
+
+	// clearing the deadline allows reading and writing again
+	require.NoError(t, clientStr.SetDeadline(time.Time{}))
+	go io.Copy(io.Discard, serverStr)
+	_, err := clientStr.Write([]byte("foo"))
+	require.NoError(t, err)
+	_, err = serverStr.Write([]byte("bar"))
+	require.NoError(t, err)
+	b := make([]byte, 3)
+	_, err = io.ReadFull(clientStr, b)
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(b))
+
+	// a deadline in the past fails reads and writes right away
+	require.NoError(t, clientStr.SetDeadline(time.Now().Add(-time.Second)))
+	_, err = clientStr.Write([]byte("foo"))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	_, err = clientStr.Read(b)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestStreamWriteDeadlineExpiredOnSet(t *testing.T) {
+	client, _ := getDetachedDataChannels(t)
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+
+	isExpiredOnSet := func() bool {
+		clientStr.mx.Lock()
+		defer clientStr.mx.Unlock()
+		return clientStr.writeDeadlineExpiredOnSet
+	}
+
+	require.NoError(t, clientStr.SetWriteDeadline(time.Unix(0, 0)))
+	require.True(t, isExpiredOnSet())
+	_, err := clientStr.Write([]byte("foo"))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	require.NoError(t, clientStr.SetWriteDeadline(time.Time{}))
+	require.False(t, isExpiredOnSet())
+
+	// deadlines that just expired are common, e.g. to unblock writers
+	require.NoError(t, clientStr.SetDeadline(time.Now()))
+	require.False(t, isExpiredOnSet())
+	require.NoError(t, clientStr.SetWriteDeadline(time.Now().Add(time.Hour)))
+	require.False(t, isExpiredOnSet())
+}
+
+func TestStreamWriteDeadlineExpiredOnSetBlockedWrite(t *testing.T) {
+	require.NoError(t, logging.SetLogLevel("webrtc-transport", "debug"))
+	pipe := logging.NewPipeReader()
+	defer pipe.Close()
+	logged := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(pipe)
+		for scanner.Scan() {
+			if strings.Contains(scanner.Text(), "already expired when it was set") {
+				close(logged)
+				break
+			}
+		}
+		io.Copy(io.Discard, pipe)
+	}()
+
+	config := defaultStreamConfig
+	config.sendBudget = newSendBudget(defaultMinMessageSize)
+	client, _ := getDetachedDataChannels(t)
+	clientStr := newStream(client.dc, client.rwc, config, func() {})
+	// All space on the send budget is used by other streams, so the write has to wait.
+	config.sendBudget.mx.Lock()
+	config.sendBudget.used = config.sendBudget.max
+	config.sendBudget.mx.Unlock()
+
+	stalls := clientStr.WriteStats().Stalls
+	errC := make(chan error, 1)
+	go func() {
+		_, err := clientStr.Write([]byte("foobar"))
+		errC <- err
+	}()
+	require.Eventually(t, func() bool { return clientStr.WriteStats().Stalls > stalls }, 5*time.Second, 10*time.Millisecond)
+
+	// the expired deadline is logged for writes that are already blocked
+	require.NoError(t, clientStr.SetWriteDeadline(time.Unix(0, 0)))
+	require.ErrorIs(t, <-errC, os.ErrDeadlineExceeded)
+	select {
+	case <-logged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the expired write deadline wasn't logged")
+	}
+}
+
 func TestStreamReadAfterClose(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
 
 	serverStr.Close()
 	b := make([]byte, 1)
@@ -338,8 +474,8 @@ func TestStreamReadAfterClose(t *testing.T) {
 
 	client, server = getDetachedDataChannels(t)
 
-	clientStr = newStream(client.dc, client.rwc, func() {})
-	serverStr = newStream(server.dc, server.rwc, func() {})
+	clientStr = newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
 
 	serverStr.Reset()
 	b = make([]byte, 1)
@@ -353,8 +489,8 @@ func TestStreamCloseAfterFINACK(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	done := make(chan bool, 1)
-	clientStr := newStream(client.dc, client.rwc, func() { done <- true })
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() { done <- true })
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
 
 	go func() {
 		done <- true
@@ -386,8 +522,8 @@ func TestStreamFinAckAfterStopSending(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	done := make(chan bool, 1)
-	clientStr := newStream(client.dc, client.rwc, func() { done <- true })
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() { done <- true })
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
 
 	go func() {
 		clientStr.CloseRead()
@@ -422,8 +558,8 @@ func TestStreamConcurrentClose(t *testing.T) {
 
 	start := make(chan bool, 2)
 	done := make(chan bool, 2)
-	clientStr := newStream(client.dc, client.rwc, func() { done <- true })
-	serverStr := newStream(server.dc, server.rwc, func() { done <- true })
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() { done <- true })
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() { done <- true })
 
 	go func() {
 		start <- true
@@ -452,7 +588,7 @@ func TestStreamResetAfterClose(t *testing.T) {
 	client, _ := getDetachedDataChannels(t)
 
 	done := make(chan bool, 2)
-	clientStr := newStream(client.dc, client.rwc, func() { done <- true })
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() { done <- true })
 	clientStr.Close()
 
 	select {
@@ -473,7 +609,7 @@ func TestStreamDataChannelCloseOnFINACK(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	done := make(chan bool, 1)
-	clientStr := newStream(client.dc, client.rwc, func() { done <- true })
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() { done <- true })
 
 	clientStr.Close()
 
@@ -507,8 +643,8 @@ func TestStreamDataChannelCloseOnFINACK(t *testing.T) {
 func TestStreamChunking(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
 
 	const N = (16 << 10) + 1000
 	go func() {
@@ -526,3 +662,1297 @@ func TestStreamChunking(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, nn+n, N)
 }
+
+func TestStreamReadFrom(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	data := make([]byte, 5<<20)
+	rand.Read(data)
+
+	errC := make(chan error, 1)
+	go func() {
+		// wrap the reader to hide the WriterTo implementation of bytes.Reader
+		n, err := io.Copy(clientStr, io.LimitReader(bytes.NewReader(data), int64(len(data))))
+		if err == nil && n != int64(len(data)) {
+			err = fmt.Errorf("expected to copy %d bytes, copied %d", len(data), n)
+		}
+		if err == nil {
+			err = clientStr.CloseWrite()
+		}
+		errC <- err
+	}()
+
+	b, err := io.ReadAll(serverStr)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+	require.NoError(t, <-errC)
+}
+
+func TestStreamReadFromReset(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	const total = 50 << 20
+	type result struct {
+		n   int64
+		err error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		n, err := clientStr.ReadFrom(io.LimitReader(rand.Reader, total))
+		resC <- result{n: n, err: err}
+	}()
+
+	// read some data, then reset the stream while the copy is in progress
+	const read = 1 << 20
+	_, err := io.ReadFull(serverStr, make([]byte, read))
+	require.NoError(t, err)
+	require.NoError(t, clientStr.Reset())
+
+	select {
+	case res := <-resC:
+		require.ErrorIs(t, res.err, network.ErrReset)
+		require.GreaterOrEqual(t, res.n, int64(read))
+		require.Less(t, res.n, int64(total))
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadFrom should have returned after the stream was reset")
+	}
+
+	n, err := clientStr.ReadFrom(bytes.NewReader([]byte("foobar")))
+	require.ErrorIs(t, err, network.ErrReset)
+	require.Zero(t, n)
+}
+
+// countingWriter counts the number of messages written
+type countingWriter struct {
+	pbio.Writer
+	count atomic.Int64
+}
+
+func (w *countingWriter) WriteMsg(msg proto.Message) error {
+	w.count.Add(1)
+	return w.Writer.WriteMsg(msg)
+}
+
+func TestStreamWriteBuffers(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	cw := &countingWriter{Writer: clientStr.writer}
+	clientStr.writer = cw
+
+	var bufs [][]byte
+	var expected []byte
+	for i := 0; i < 1000; i++ {
+		b := make([]byte, i%100)
+		rand.Read(b)
+		bufs = append(bufs, b)
+		expected = append(expected, b...)
+	}
+	// add a few buffers larger than a single message
+	for i := 0; i < 3; i++ {
+		b := make([]byte, maxMessageSize+1234)
+		rand.Read(b)
+		bufs = append(bufs, b, nil, []byte("foobar"))
+		expected = append(expected, b...)
+		expected = append(expected, "foobar"...)
+	}
+	bufsCopy := append([][]byte{}, bufs...)
+
+	errC := make(chan error, 1)
+	go func() {
+		n, err := clientStr.WriteBuffers(bufs)
+		if err == nil && n != len(expected) {
+			err = fmt.Errorf("expected to write %d bytes, wrote %d", len(expected), n)
+		}
+		if err == nil {
+			err = clientStr.CloseWrite()
+		}
+		errC <- err
+	}()
+
+	b, err := io.ReadAll(serverStr)
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+	require.NoError(t, <-errC)
+	require.Equal(t, bufsCopy, bufs, "WriteBuffers shouldn't modify the buffers")
+	// every message can carry at most maxMessageSize bytes
+	require.LessOrEqual(t, cw.count.Load(), int64(2*len(expected)/maxMessageSize+2))
+}
+
+func TestStreamWriteMessages(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	// Write more than fits into the send buffer, so that WriteMessages has to wait for space
+	// in between.
+	const numPayloads = 100
+	payloads := make([][]byte, numPayloads)
+	for i := range payloads {
+		payloads[i] = bytes.Repeat([]byte{'a'}, 1000)
+	}
+
+	batchErrC := make(chan error, 1)
+	go func() {
+		n, err := clientStr.WriteMessages(payloads)
+		if err == nil && n != numPayloads*1000 {
+			err = fmt.Errorf("expected to write %d bytes, wrote %d", numPayloads*1000, n)
+		}
+		batchErrC <- err
+	}()
+	require.Eventually(t, func() bool { return clientStr.WriteStats().Messages > 0 }, 5*time.Second, time.Millisecond)
+
+	const numWriters, numWrites = 4, 50
+	var wg sync.WaitGroup
+	writeErrC := make(chan error, numWriters)
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numWrites; j++ {
+				if _, err := clientStr.Write(bytes.Repeat([]byte{'b'}, 100)); err != nil {
+					writeErrC <- err
+					return
+				}
+			}
+		}()
+	}
+
+	readErrC := make(chan error, 1)
+	var received []byte
+	go func() {
+		var err error
+		received, err = io.ReadAll(serverStr)
+		readErrC <- err
+	}()
+
+	require.NoError(t, <-batchErrC)
+	wg.Wait()
+	close(writeErrC)
+	require.NoError(t, <-writeErrC)
+	require.NoError(t, clientStr.CloseWrite())
+	require.NoError(t, <-readErrC)
+
+	require.Len(t, received, numPayloads*1000+numWriters*numWrites*100)
+	// the payloads of WriteMessages are not interleaved with concurrent writes
+	first := bytes.IndexByte(received, 'a')
+	require.Equal(t, bytes.Repeat([]byte{'a'}, numPayloads*1000), received[first:first+numPayloads*1000])
+	// every payload is sent in its own message, the data of concurrent writes might be coalesced
+	require.GreaterOrEqual(t, clientStr.WriteStats().Messages, uint64(numPayloads+1))
+	require.LessOrEqual(t, clientStr.WriteStats().Messages, uint64(numPayloads+numWriters*numWrites))
+}
+
+func TestStreamWriteMessagesReset(t *testing.T) {
+	client, _ := getDetachedDataChannels(t)
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+
+	// The peer doesn't read, so WriteMessages blocks once the peer's receive window is full.
+	payloads := make([][]byte, 200)
+	for i := range payloads {
+		payloads[i] = make([]byte, 10000)
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		n, err := clientStr.WriteMessages(payloads)
+		resC <- result{n, err}
+	}()
+	require.Eventually(t, func() bool { return clientStr.WriteStats().BytesWritten > 1<<20 }, 5*time.Second, 10*time.Millisecond)
+
+	writeErrC := make(chan error, 1)
+	go func() {
+		_, err := clientStr.Write([]byte("foobar"))
+		writeErrC <- err
+	}()
+	clientStr.Reset()
+
+	res := <-resC
+	require.ErrorIs(t, res.err, network.ErrReset)
+	require.Equal(t, int(clientStr.WriteStats().BytesWritten), res.n)
+	require.ErrorIs(t, <-writeErrC, network.ErrReset)
+}
+
+// fillSendBuffer writes on s until the send buffer is full. The peer must not read, so that no
+// more data is sent once its receive window is full.
+func fillSendBuffer(t testing.TB, s *stream) {
+	t.Helper()
+	b := make([]byte, s.config.minMessageSize-protoOverhead-varintOverhead)
+	// The condition runs on a different goroutine, so it can't fail the test.
+	var err error
+	require.Eventually(t, func() bool {
+		for s.AvailableSendSpace() >= s.config.minMessageSize {
+			if _, err = s.Write(b); err != nil {
+				return true
+			}
+		}
+		if s.WriteStats().BytesWritten <= 1<<20 {
+			return false
+		}
+		// make sure that the send buffer isn't draining anymore
+		time.Sleep(100 * time.Millisecond)
+		return s.AvailableSendSpace() < s.config.minMessageSize
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+}
+
+func TestStreamWriteQueueCoalescing(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	fillSendBuffer(t, clientStr)
+	messages := clientStr.WriteStats().Messages
+
+	const numWriters = 3
+	errC := make(chan error, numWriters)
+	for i := 0; i < numWriters; i++ {
+		go func() {
+			n, err := clientStr.Write(bytes.Repeat([]byte{'a'}, 100))
+			if err == nil && n != 100 {
+				err = fmt.Errorf("expected to write 100 bytes, wrote %d", n)
+			}
+			errC <- err
+		}()
+	}
+	require.Eventually(t, func() bool {
+		clientStr.mx.Lock()
+		defer clientStr.mx.Unlock()
+		return len(clientStr.writeQueue) == numWriters
+	}, 5*time.Second, 10*time.Millisecond)
+
+	go io.Copy(io.Discard, serverStr)
+	for i := 0; i < numWriters; i++ {
+		require.NoError(t, <-errC)
+	}
+	// all queued writes are sent in a single message
+	require.Equal(t, messages+1, clientStr.WriteStats().Messages)
+	clientStr.mx.Lock()
+	require.Empty(t, clientStr.writeQueue)
+	clientStr.mx.Unlock()
+}
+
+func TestStreamWriteQueueOrdering(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	// Every byte holds the index of the writer in the upper 2 bits, and a counter in the lower
+	// 6 bits, so that the data of every writer can be checked separately.
+	const numWriters, numWrites = 4, 100
+	data := make([][]byte, numWriters)
+	for i := range data {
+		data[i] = make([]byte, numWrites*maxMessageSize/4)
+		for j := range data[i] {
+			data[i][j] = byte(i<<6 | j&0x3f)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errC := make(chan error, numWriters)
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(b []byte) {
+			defer wg.Done()
+			for j := 0; j < numWrites; j++ {
+				size := 1 + mrand.Intn(maxMessageSize/4)
+				n, err := clientStr.Write(b[:size])
+				if err == nil && n != size {
+					err = fmt.Errorf("expected to write %d bytes, wrote %d", size, n)
+				}
+				if err != nil {
+					errC <- err
+					return
+				}
+				b = b[size:]
+			}
+		}(data[i])
+	}
+
+	readErrC := make(chan error, 1)
+	var received []byte
+	go func() {
+		var err error
+		received, err = io.ReadAll(serverStr)
+		readErrC <- err
+	}()
+	wg.Wait()
+	close(errC)
+	require.NoError(t, <-errC)
+	require.NoError(t, clientStr.CloseWrite())
+	require.NoError(t, <-readErrC)
+
+	var next [numWriters]byte
+	for i, b := range received {
+		w := b >> 6
+		require.Equal(t, next[w], b&0x3f, "unexpected byte at offset %d", i)
+		next[w] = (next[w] + 1) & 0x3f
+	}
+	require.Equal(t, int(clientStr.WriteStats().BytesWritten), len(received))
+}
+
+func TestStreamWriteQueueReset(t *testing.T) {
+	client, _ := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	fillSendBuffer(t, clientStr)
+
+	const numWriters = 3
+	errC := make(chan error, numWriters)
+	for i := 0; i < numWriters; i++ {
+		go func() {
+			n, err := clientStr.Write([]byte("foobar"))
+			if err != nil && n != 0 {
+				err = fmt.Errorf("expected to write 0 bytes, wrote %d", n)
+			}
+			errC <- err
+		}()
+	}
+	require.Eventually(t, func() bool {
+		clientStr.mx.Lock()
+		defer clientStr.mx.Unlock()
+		return len(clientStr.writeQueue) == numWriters
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, clientStr.Reset())
+	for i := 0; i < numWriters; i++ {
+		require.ErrorIs(t, <-errC, network.ErrReset)
+	}
+	clientStr.mx.Lock()
+	require.Empty(t, clientStr.writeQueue)
+	clientStr.mx.Unlock()
+}
+
+func benchmarkStreamWrite(b *testing.B, write func(s *stream, bufs [][]byte) error) {
+	client, server := getDetachedDataChannels(b)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	cw := &countingWriter{Writer: clientStr.writer}
+	clientStr.writer = cw
+	go io.Copy(io.Discard, serverStr)
+
+	bufs := make([][]byte, 100)
+	for i := range bufs {
+		bufs[i] = make([]byte, 64)
+	}
+	b.SetBytes(int64(len(bufs) * 64))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := write(clientStr, bufs); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(cw.count.Load())/float64(b.N), "msgs/op")
+}
+
+func BenchmarkStreamWriteSeparate(b *testing.B) {
+	benchmarkStreamWrite(b, func(s *stream, bufs [][]byte) error {
+		for _, buf := range bufs {
+			if _, err := s.Write(buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkStreamWriteBuffers(b *testing.B) {
+	benchmarkStreamWrite(b, func(s *stream, bufs [][]byte) error {
+		_, err := s.WriteBuffers(bufs)
+		return err
+	})
+}
+
+func TestStreamWriteString(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	str := strings.Repeat("foobar", maxMessageSize)
+	readC := make(chan []byte, 1)
+	go func() {
+		b, err := io.ReadAll(serverStr)
+		assert.NoError(t, err)
+		readC <- b
+	}()
+	n, err := io.WriteString(clientStr, str)
+	require.NoError(t, err)
+	require.Equal(t, len(str), n)
+	n, err = clientStr.WriteString("")
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.NoError(t, clientStr.CloseWrite())
+	require.Equal(t, str, string(<-readC))
+
+	n, err = clientStr.WriteString("foobar")
+	require.ErrorIs(t, err, ErrWriteAfterClose)
+	require.Zero(t, n)
+}
+
+func TestStreamWriteWakeups(t *testing.T) {
+	config := defaultStreamConfig
+	config.sendBudget = newSendBudget(defaultMinMessageSize)
+	client, _ := getDetachedDataChannels(t)
+	clientStr := newStream(client.dc, client.rwc, config, func() {})
+	// wait for the initial data on the data channel to be sent, so that the writers aren't
+	// woken up by the buffered amount dropping
+	require.Eventually(t, func() bool { return clientStr.BufferedAmount() == 0 }, 5*time.Second, 10*time.Millisecond)
+	// All space on the send budget is used by other streams, so writers have to wait.
+	config.sendBudget.mx.Lock()
+	config.sendBudget.used = config.sendBudget.max
+	config.sendBudget.mx.Unlock()
+
+	const numWriters = 10
+	errC := make(chan error, numWriters)
+	for i := 0; i < numWriters; i++ {
+		go func() {
+			_, err := clientStr.Write([]byte("foobar"))
+			errC <- err
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return clientStr.WriteStats().Stalls == numWriters
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// setting the same deadline over and over again only wakes up the writers once
+	deadline := time.Now().Add(time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clientStr.SetWriteDeadline(deadline)
+		}()
+	}
+	wg.Wait()
+	require.Eventually(t, func() bool {
+		return clientStr.WriteStats().Stalls == 2*numWriters
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(numWriters), clientStr.WriteStats().Wakeups)
+
+	// closing and resetting the stream concurrently wakes them up once more
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			clientStr.CloseWrite()
+		}()
+		go func() {
+			defer wg.Done()
+			clientStr.Reset()
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < numWriters; i++ {
+		err := <-errC
+		require.True(t, errors.Is(err, ErrWriteAfterClose) || errors.Is(err, network.ErrReset), err)
+	}
+	require.LessOrEqual(t, clientStr.WriteStats().Wakeups, uint64(2*numWriters))
+}
+
+func benchmarkStreamWriteString(b *testing.B, write func(s *stream, str string) error) {
+	client, server := getDetachedDataChannels(b)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	go io.Copy(io.Discard, serverStr)
+
+	str := strings.Repeat("a", 1000)
+	b.SetBytes(int64(len(str)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := write(clientStr, str); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStreamWriteString(b *testing.B) {
+	benchmarkStreamWriteString(b, func(s *stream, str string) error {
+		_, err := s.WriteString(str)
+		return err
+	})
+}
+
+func BenchmarkStreamWriteStringConversion(b *testing.B) {
+	benchmarkStreamWriteString(b, func(s *stream, str string) error {
+		_, err := s.Write([]byte(str))
+		return err
+	})
+}
+
+// BenchmarkStreamWriteConcurrent measures a bursty workload of many goroutines doing small
+// writes. The writes waiting for space on the send buffer are coalesced, so that they need a
+// lot less than one message per write.
+func BenchmarkStreamWriteConcurrent(b *testing.B) {
+	client, server := getDetachedDataChannels(b)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	cw := &countingWriter{Writer: clientStr.writer}
+	clientStr.writer = cw
+	go io.Copy(io.Discard, serverStr)
+
+	const numWriters, numWrites = 16, 100
+	buf := make([]byte, 1000)
+	b.SetBytes(int64(numWriters * numWrites * len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < numWriters; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < numWrites; k++ {
+					if _, err := clientStr.Write(buf); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(cw.count.Load())/float64(b.N*numWriters*numWrites), "msgs/write")
+}
+
+// bufferCheckingWriter records the maximum amount of data buffered on the data channel
+// before writing a message
+type bufferCheckingWriter struct {
+	pbio.Writer
+	dc          *datachannel.DataChannel
+	maxBuffered atomic.Uint64
+}
+
+func (w *bufferCheckingWriter) WriteMsg(msg proto.Message) error {
+	if b := w.dc.BufferedAmount() + uint64(proto.Size(msg)); b > w.maxBuffered.Load() {
+		w.maxBuffered.Store(b)
+	}
+	return w.Writer.WriteMsg(msg)
+}
+
+func TestStreamSmallSendBuffer(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	cfg := streamConfig{maxMessageSize: maxMessageSize, maxSendBuffer: 4096, minMessageSize: 512}
+	clientStr := newStream(client.dc, client.rwc, cfg, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	bw := &bufferCheckingWriter{Writer: clientStr.writer, dc: clientStr.dataChannel}
+	clientStr.writer = bw
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	errC := make(chan error, 1)
+	go func() {
+		_, err := clientStr.Write(data)
+		if err == nil {
+			err = clientStr.CloseWrite()
+		}
+		errC <- err
+	}()
+
+	b, err := io.ReadAll(serverStr)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+	require.NoError(t, <-errC)
+	require.LessOrEqual(t, bw.maxBuffered.Load(), uint64(cfg.maxSendBuffer))
+}
+
+func TestStreamMessageSizeTooSmall(t *testing.T) {
+	client, _ := getDetachedDataChannels(t)
+
+	config := defaultStreamConfig
+	config.maxMessageSize = protoOverhead + varintOverhead
+	config.minMessageSize = 1
+	require.Error(t, config.validate())
+	clientStr := newStream(client.dc, client.rwc, config, func() {})
+
+	_, err := clientStr.Write([]byte("foobar"))
+	require.ErrorIs(t, err, errMessageSizeTooSmall)
+	_, err = clientStr.WriteMessages([][]byte{[]byte("foo"), []byte("bar")})
+	require.ErrorIs(t, err, errMessageSizeTooSmall)
+	_, err = clientStr.ReadFrom(strings.NewReader("foobar"))
+	require.ErrorIs(t, err, errMessageSizeTooSmall)
+	require.Zero(t, clientStr.WriteStats().Messages)
+
+	config.maxMessageSize = protoOverhead + varintOverhead + minPayloadSize
+	config.minMessageSize = config.maxMessageSize
+	require.NoError(t, config.validate())
+}
+
+func TestStreamAvailableSendSpace(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	require.Eventually(t, func() bool {
+		return clientStr.BufferedAmount() == 0 && clientStr.AvailableSendSpace() == defaultMaxSendBuffer
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The peer doesn't read, so the data stays buffered once the peer's receive window is full.
+	data := make([]byte, 2<<20)
+	errC := make(chan error, 1)
+	go func() {
+		_, err := clientStr.Write(data)
+		errC <- err
+	}()
+	require.Eventually(t, func() bool {
+		return clientStr.WriteStats().BytesWritten > 1<<20 && clientStr.BufferedAmount() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Less(t, clientStr.AvailableSendSpace(), defaultMaxSendBuffer)
+	require.Equal(t, defaultMaxSendBuffer-int(clientStr.BufferedAmount()), clientStr.AvailableSendSpace())
+
+	// the space recovers once the peer reads the data
+	go io.Copy(io.Discard, serverStr)
+	require.NoError(t, <-errC)
+	require.Eventually(t, func() bool {
+		return clientStr.BufferedAmount() == 0 && clientStr.AvailableSendSpace() == defaultMaxSendBuffer
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStreamFlush(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	readC := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(serverStr)
+		readC <- b
+	}()
+
+	_, err := clientStr.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, clientStr.CloseWrite())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, clientStr.Flush(ctx))
+	require.Zero(t, clientStr.dataChannel.BufferedAmount())
+	// the threshold is restored after flushing
+	require.Equal(t, uint64(defaultStreamConfig.sendBufferLowThreshold), clientStr.dataChannel.BufferedAmountLowThreshold())
+	require.Equal(t, data, <-readC)
+}
+
+func TestStreamFlushBlocked(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	// The server doesn't read. Once the receive window of the server (1 MiB by default) is full,
+	// no more data is sent out and the send buffer doesn't drain.
+	var written atomic.Int64
+	go func() {
+		b := make([]byte, 1<<10)
+		for {
+			n, err := clientStr.Write(b)
+			written.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	var lastBuffered uint64
+	require.Eventually(t, func() bool {
+		buffered := clientStr.dataChannel.BufferedAmount()
+		stalled := written.Load() > 1<<20 && buffered > 0 && buffered == lastBuffered
+		lastBuffered = buffered
+		return stalled
+	}, 10*time.Second, 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, clientStr.Flush(ctx), context.DeadlineExceeded)
+
+	time.AfterFunc(100*time.Millisecond, func() { clientStr.Reset() })
+	require.ErrorIs(t, clientStr.Flush(context.Background()), network.ErrReset)
+}
+
+func TestStreamWriteStats(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	_, err := clientStr.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, StreamWriteStats{BytesWritten: 6, Messages: 1}, clientStr.WriteStats())
+
+	// writing more than the send buffer can hold, while the server is not reading, stalls
+	const N = 4 * defaultMaxSendBuffer
+	errC := make(chan error, 1)
+	go func() {
+		_, err := clientStr.Write(make([]byte, N))
+		errC <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, err = io.ReadFull(serverStr, make([]byte, N+6))
+	require.NoError(t, err)
+	require.NoError(t, <-errC)
+
+	stats := clientStr.WriteStats()
+	require.Equal(t, uint64(N+6), stats.BytesWritten)
+	require.Greater(t, stats.Messages, uint64(N/maxMessageSize))
+	require.NotZero(t, stats.Stalls)
+}
+
+func TestStreamWriteContext(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n, err := clientStr.WriteContext(ctx, []byte("foobar"))
+	require.ErrorIs(t, err, context.Canceled)
+	require.Zero(t, n)
+
+	// The server doesn't read, so the write will block once the server's receive window is full.
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+	data := make([]byte, 10<<20)
+	rand.Read(data)
+	n, err = clientStr.WriteContext(ctx, data)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Greater(t, n, 0)
+	require.Less(t, n, len(data))
+
+	// the stream is still usable
+	readC := make(chan []byte, 1)
+	go func() {
+		b, err := io.ReadAll(serverStr)
+		assert.NoError(t, err)
+		readC <- b
+	}()
+	n2, err := clientStr.WriteContext(context.Background(), []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, 6, n2)
+	require.NoError(t, clientStr.CloseWrite())
+	require.Equal(t, append(data[:n:n], "foobar"...), <-readC)
+}
+
+func TestStreamWriteContextDeadline(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	clientStr.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := clientStr.WriteContext(context.Background(), make([]byte, 10<<20))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestStreamWriteResumesBelowThreshold(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	cfg := streamConfig{maxMessageSize: maxMessageSize, maxSendBuffer: defaultMaxSendBuffer, minMessageSize: defaultMinMessageSize, sendBufferLowThreshold: 4096}
+	clientStr := newStream(client.dc, client.rwc, cfg, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	require.Equal(t, uint64(4096), clientStr.dataChannel.BufferedAmountLowThreshold())
+
+	// The server doesn't read, so the write blocks once the receive window of the server is full.
+	const N = 4 << 20
+	errC := make(chan error, 1)
+	go func() {
+		_, err := clientStr.Write(make([]byte, N))
+		errC <- err
+	}()
+	var lastBuffered uint64
+	require.Eventually(t, func() bool {
+		buffered := clientStr.dataChannel.BufferedAmount()
+		stalled := clientStr.WriteStats().BytesWritten > 1<<20 && buffered > 0 && buffered == lastBuffered
+		lastBuffered = buffered
+		return stalled
+	}, 10*time.Second, 100*time.Millisecond)
+	messages := clientStr.WriteStats().Messages
+
+	go io.Copy(io.Discard, serverStr)
+
+	// Once the buffered amount drops below the threshold, the writer resumes.
+	var belowThreshold time.Time
+	require.Eventually(t, func() bool {
+		if belowThreshold.IsZero() && clientStr.dataChannel.BufferedAmount() <= 4096 {
+			belowThreshold = time.Now()
+		}
+		return clientStr.WriteStats().Messages > messages
+	}, 5*time.Second, time.Millisecond)
+	if !belowThreshold.IsZero() {
+		require.Less(t, time.Since(belowThreshold), 100*time.Millisecond)
+	}
+
+	select {
+	case err := <-errC:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("write should have completed")
+	}
+}
+
+func TestStreamResetWithError(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	_, err := clientStr.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, clientStr.ResetWithError(42))
+	_, err = clientStr.Write([]byte("foobar"))
+	require.ErrorIs(t, err, network.ErrReset)
+
+	b, err := io.ReadAll(serverStr)
+	require.Equal(t, []byte("foobar"), b)
+	require.ErrorIs(t, err, network.ErrReset)
+	var resetErr *StreamResetError
+	require.ErrorAs(t, err, &resetErr)
+	require.Equal(t, &StreamResetError{ErrorCode: 42, Remote: true, Cause: ResetCauseRemoteReset}, resetErr)
+	// subsequent reads return the same error
+	_, err = serverStr.Read(make([]byte, 1))
+	require.ErrorAs(t, err, &resetErr)
+	require.Equal(t, uint32(42), resetErr.ErrorCode)
+}
+
+func TestStreamResetWithoutError(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	require.NoError(t, clientStr.Reset())
+	_, err := serverStr.Read(make([]byte, 1))
+	require.ErrorIs(t, err, network.ErrReset)
+	var resetErr *StreamResetError
+	require.ErrorAs(t, err, &resetErr)
+	require.Zero(t, resetErr.ErrorCode)
+}
+
+func TestStreamResetError(t *testing.T) {
+	t.Run("not reset", func(t *testing.T) {
+		client, server := getDetachedDataChannels(t)
+		clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+		_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+		require.NoError(t, clientStr.ResetError())
+		require.NoError(t, clientStr.CloseWrite())
+		require.NoError(t, clientStr.ResetError())
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		client, server := getDetachedDataChannels(t)
+		clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+		serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+		require.NoError(t, clientStr.ResetWithError(42))
+		err := clientStr.ResetError()
+		require.ErrorIs(t, err, network.ErrReset)
+		var resetErr *StreamResetError
+		require.ErrorAs(t, err, &resetErr)
+		require.Equal(t, &StreamResetError{ErrorCode: 42, Cause: ResetCauseLocal}, resetErr)
+
+		_, err = serverStr.Read(make([]byte, 1))
+		require.ErrorIs(t, err, network.ErrReset)
+		require.ErrorAs(t, serverStr.ResetError(), &resetErr)
+		require.Equal(t, &StreamResetError{ErrorCode: 42, Remote: true, Cause: ResetCauseRemoteReset}, resetErr)
+
+		// resetting the stream after the peer reset it doesn't change the reason
+		require.NoError(t, serverStr.Reset())
+		require.ErrorAs(t, serverStr.ResetError(), &resetErr)
+		require.Equal(t, ResetCauseRemoteReset, resetErr.Cause)
+	})
+
+	t.Run("stop sending", func(t *testing.T) {
+		client, server := getDetachedDataChannels(t)
+		clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+		serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+		require.NoError(t, serverStr.CloseRead())
+		// the STOP_SENDING is processed by the control message reader
+		require.NoError(t, clientStr.CloseRead())
+		require.Eventually(t, func() bool {
+			_, err := clientStr.Write([]byte("foobar"))
+			return errors.Is(err, network.ErrReset)
+		}, 5*time.Second, 10*time.Millisecond)
+		var resetErr *StreamResetError
+		require.ErrorAs(t, clientStr.ResetError(), &resetErr)
+		require.Equal(t, &StreamResetError{Remote: true, Cause: ResetCauseStopSending}, resetErr)
+	})
+}
+
+func TestStreamWriteBufferedAmountOverflow(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	cw := &countingWriter{Writer: clientStr.writer}
+	clientStr.writer = cw
+
+	// Bypass the stream's flow control, and enqueue more data on the data channel than the
+	// stream ever would. The server doesn't read, so the data stays buffered once the server's
+	// receive window is full.
+	b := make([]byte, 1<<10)
+	for i := 0; i < 2<<10; i++ {
+		_, err := client.rwc.Write(b)
+		require.NoError(t, err)
+	}
+	require.Greater(t, clientStr.dataChannel.BufferedAmount(), uint64(defaultMaxSendBuffer+maxTotalControlMessagesSize))
+
+	n, err := clientStr.Write([]byte("foobar"))
+	require.ErrorIs(t, err, errBufferedAmountOverflow)
+	require.Zero(t, n)
+	require.Zero(t, cw.count.Load())
+
+	_, err = clientStr.ReadFrom(bytes.NewReader([]byte("foobar")))
+	require.ErrorIs(t, err, errBufferedAmountOverflow)
+	require.Zero(t, cw.count.Load())
+}
+
+func TestStreamAnomalyHandler(t *testing.T) {
+	var mx sync.Mutex
+	var anomalies []StreamAnomaly
+	config := defaultStreamConfig
+	config.anomalyHandler = func(a StreamAnomaly) {
+		mx.Lock()
+		defer mx.Unlock()
+		anomalies = append(anomalies, a)
+	}
+
+	client, server := getDetachedDataChannels(t)
+	clientStr := newStream(client.dc, client.rwc, config, func() {})
+	_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	// enqueue more data on the data channel than the stream ever would
+	b := make([]byte, 1<<10)
+	for i := 0; i < 2<<10; i++ {
+		_, err := client.rwc.Write(b)
+		require.NoError(t, err)
+	}
+	_, err := clientStr.Write([]byte("foobar"))
+	require.ErrorIs(t, err, errBufferedAmountOverflow)
+
+	mx.Lock()
+	defer mx.Unlock()
+	require.Len(t, anomalies, 1)
+	a := anomalies[0]
+	require.Equal(t, "data channel buffered more data than the maximum amount", a.Message)
+	require.Equal(t, clientStr.id, a.StreamID)
+	require.Equal(t, defaultMaxSendBuffer, a.MaxSendBuffer)
+	require.Greater(t, a.Buffered, uint64(defaultMaxSendBuffer+maxTotalControlMessagesSize))
+}
+
+func TestStreamCloseWriteWithTimeout(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	_, err := clientStr.Write([]byte("foobar"))
+	require.NoError(t, err)
+	// the FIN_ACK is processed by the control message reader
+	require.NoError(t, clientStr.CloseRead())
+
+	readC := make(chan []byte, 1)
+	go func() {
+		b, err := io.ReadAll(serverStr)
+		assert.NoError(t, err)
+		readC <- b
+	}()
+	require.NoError(t, clientStr.CloseWriteWithTimeout(5*time.Second))
+	require.Equal(t, []byte("foobar"), <-readC)
+	// calling it again returns immediately
+	require.NoError(t, clientStr.CloseWriteWithTimeout(time.Nanosecond))
+}
+
+func TestStreamCloseWriteWithTimeoutWithoutReader(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	// the server reads the request, and responds
+	go func() {
+		b, err := io.ReadAll(serverStr)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("request"), b)
+		_, err = serverStr.Write([]byte("response"))
+		assert.NoError(t, err)
+		assert.NoError(t, serverStr.CloseWrite())
+	}()
+
+	// the client neither reads nor closes the read half while waiting for the FIN_ACK
+	_, err := clientStr.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, clientStr.CloseWriteWithTimeout(5*time.Second))
+	b, err := io.ReadAll(clientStr)
+	require.NoError(t, err)
+	require.Equal(t, []byte("response"), b)
+
+	t.Run("expires", func(t *testing.T) {
+		client, server := getDetachedDataChannels(t)
+
+		clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+		_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+		readDeadline := time.Now().Add(time.Hour)
+		require.NoError(t, clientStr.SetReadDeadline(readDeadline))
+
+		timeout := 100 * time.Millisecond
+		start := time.Now()
+		require.ErrorIs(t, clientStr.CloseWriteWithTimeout(timeout), os.ErrDeadlineExceeded)
+		require.GreaterOrEqual(t, time.Since(start), timeout)
+
+		// the read deadline is restored
+		clientStr.mx.Lock()
+		require.False(t, clientStr.readingFINACK)
+		require.Equal(t, readDeadline, clientStr.readDeadline)
+		clientStr.mx.Unlock()
+		require.NoError(t, clientStr.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		_, err := clientStr.Read(make([]byte, 10))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+}
+
+func TestStreamCloseWriteWithTimeoutConcurrentRead(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	closeC := make(chan error, 1)
+	go func() { closeC <- clientStr.CloseWriteWithTimeout(5 * time.Second) }()
+	require.Eventually(t, func() bool {
+		clientStr.mx.Lock()
+		defer clientStr.mx.Unlock()
+		return clientStr.readingFINACK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a Read doesn't wait for CloseWriteWithTimeout to stop reading
+	start := time.Now()
+	require.NoError(t, clientStr.SetReadDeadline(start.Add(100*time.Millisecond)))
+	_, err := clientStr.Read(make([]byte, 10))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+
+	// CloseWriteWithTimeout reads the FIN_ACK once the Read returned
+	go io.Copy(io.Discard, serverStr)
+	require.NoError(t, <-closeC)
+}
+
+func TestStreamCloseWriteWithTimeoutExpires(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	require.NoError(t, clientStr.CloseRead())
+
+	// the server never reads the FIN, and never sends a FIN_ACK
+	timeout := 100 * time.Millisecond
+	start := time.Now()
+	require.ErrorIs(t, clientStr.CloseWriteWithTimeout(timeout), os.ErrDeadlineExceeded)
+	require.GreaterOrEqual(t, time.Since(start), timeout)
+
+	_, err := clientStr.Write([]byte("foobar"))
+	require.ErrorIs(t, err, ErrWriteAfterClose)
+}
+
+func TestStreamWriteAfterClose(t *testing.T) {
+	t.Run("FIN sent", func(t *testing.T) {
+		client, server := getDetachedDataChannels(t)
+		clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+		_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+		require.NoError(t, clientStr.CloseWrite())
+		clientStr.mx.Lock()
+		require.Equal(t, sendStateDataSent, clientStr.sendState)
+		clientStr.mx.Unlock()
+		_, err := clientStr.Write([]byte("foobar"))
+		require.ErrorIs(t, err, ErrWriteAfterClose)
+		require.NotErrorIs(t, err, network.ErrReset)
+	})
+
+	t.Run("FIN_ACK received", func(t *testing.T) {
+		client, server := getDetachedDataChannels(t)
+		clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+		serverStr := newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+		go io.Copy(io.Discard, serverStr)
+		// the FIN_ACK is processed by the control message reader
+		require.NoError(t, clientStr.CloseRead())
+		require.NoError(t, clientStr.CloseWriteWithTimeout(5*time.Second))
+		clientStr.mx.Lock()
+		require.Equal(t, sendStateDataReceived, clientStr.sendState)
+		clientStr.mx.Unlock()
+		_, err := clientStr.Write([]byte("foobar"))
+		require.ErrorIs(t, err, ErrWriteAfterClose)
+		require.NotErrorIs(t, err, network.ErrReset)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		client, server := getDetachedDataChannels(t)
+		clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+		_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+		require.NoError(t, clientStr.CloseWrite())
+		require.NoError(t, clientStr.Reset())
+		_, err := clientStr.Write([]byte("foobar"))
+		require.ErrorIs(t, err, network.ErrReset)
+		require.NotErrorIs(t, err, ErrWriteAfterClose)
+	})
+}
+
+func TestStreamCloseWriteWithTimeoutReset(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	time.AfterFunc(100*time.Millisecond, func() { clientStr.Reset() })
+	require.ErrorIs(t, clientStr.CloseWriteWithTimeout(5*time.Second), network.ErrReset)
+}
+
+func TestStreamZeroLengthWrite(t *testing.T) {
+	t.Run("open", func(t *testing.T) {
+		client, server := getDetachedDataChannels(t)
+		clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+		_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+		cw := &countingWriter{Writer: clientStr.writer}
+		clientStr.writer = cw
+
+		n, err := clientStr.Write(nil)
+		require.NoError(t, err)
+		require.Zero(t, n)
+		n, err = clientStr.Write([]byte{})
+		require.NoError(t, err)
+		require.Zero(t, n)
+		n, err = clientStr.WriteBuffers([][]byte{nil, {}})
+		require.NoError(t, err)
+		require.Zero(t, n)
+		require.Zero(t, cw.count.Load(), "zero-length writes shouldn't send any messages")
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		client, server := getDetachedDataChannels(t)
+		clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+		_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+		require.NoError(t, clientStr.Reset())
+		_, err := clientStr.Write(nil)
+		require.ErrorIs(t, err, network.ErrReset)
+		_, err = clientStr.Write([]byte{})
+		require.ErrorIs(t, err, network.ErrReset)
+	})
+
+	t.Run("FIN sent", func(t *testing.T) {
+		client, server := getDetachedDataChannels(t)
+		clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+		_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+		cw := &countingWriter{Writer: clientStr.writer}
+		clientStr.writer = cw
+
+		require.NoError(t, clientStr.CloseWrite())
+		count := cw.count.Load()
+		_, err := clientStr.Write(nil)
+		require.ErrorIs(t, err, ErrWriteAfterClose)
+		_, err = clientStr.Write([]byte{})
+		require.ErrorIs(t, err, ErrWriteAfterClose)
+		require.Equal(t, count, cw.count.Load())
+	})
+}
+
+func TestStreamWriteDeadlineUpdate(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+
+	// The server doesn't read, so the write blocks once the server's receive window is full.
+	timeout := 100 * time.Millisecond
+	if os.Getenv("CI") != "" {
+		timeout *= 5
+	}
+	start := time.Now()
+	clientStr.SetWriteDeadline(start.Add(timeout))
+	// extend the deadline while the write is blocked
+	time.AfterFunc(timeout/2, func() { clientStr.SetWriteDeadline(start.Add(2 * timeout)) })
+	_, err := clientStr.Write(make([]byte, 10<<20))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	took := time.Since(start)
+	require.GreaterOrEqual(t, took, 2*timeout)
+	require.LessOrEqual(t, took, 3*timeout)
+
+	// remove the deadline while the write is blocked
+	clientStr.SetWriteDeadline(time.Now().Add(timeout))
+	time.AfterFunc(timeout/2, func() { clientStr.SetWriteDeadline(time.Time{}) })
+	errC := make(chan error, 1)
+	go func() {
+		_, err := clientStr.Write(make([]byte, 10<<20))
+		errC <- err
+	}()
+	select {
+	case err := <-errC:
+		t.Fatalf("write shouldn't have returned: %v", err)
+	case <-time.After(3 * timeout):
+	}
+	require.NoError(t, clientStr.Reset())
+	require.ErrorIs(t, <-errC, network.ErrReset)
+}
+
+type discardWriter struct{}
+
+func (discardWriter) WriteMsg(proto.Message) error { return nil }
+
+func BenchmarkStreamWriteDeadline(b *testing.B) {
+	client, server := getDetachedDataChannels(b)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	// measure the overhead of the write path, excluding the data channel
+	clientStr.writer = discardWriter{}
+
+	buf := make([]byte, 100)
+	clientStr.SetWriteDeadline(time.Now().Add(time.Hour))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := clientStr.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStreamWriteDeadlineBlocked(b *testing.B) {
+	client, server := getDetachedDataChannels(b)
+
+	clientStr := newStream(client.dc, client.rwc, defaultStreamConfig, func() {})
+	// the server never reads, so every write blocks until its deadline expires
+	_ = newStream(server.dc, server.rwc, defaultStreamConfig, func() {})
+	fillSendBuffer(b, clientStr)
+
+	buf := make([]byte, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clientStr.SetWriteDeadline(time.Now().Add(10 * time.Microsecond))
+		if _, err := clientStr.Write(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+			b.Fatalf("expected the write to time out, got %v", err)
+		}
+	}
+}
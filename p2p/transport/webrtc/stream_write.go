@@ -1,125 +1,468 @@
 package libp2pwebrtc
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/p2p/transport/webrtc/pb"
 )
 
-var errWriteAfterClose = errors.New("write after close")
+// ErrWriteAfterClose is returned from writes on a stream after its write side was closed with
+// CloseWrite. It's distinct from network.ErrReset, which is returned after the stream was reset.
+var ErrWriteAfterClose = errors.New("write after close")
 
-// If we have less space than minMessageSize, we don't put a new message on the data channel.
-// Instead, we wait until more space opens up.
-const minMessageSize = 1 << 10
+// errBufferedAmountOverflow is returned from Write when the data channel has more data buffered
+// than the stream could have enqueued.
+var errBufferedAmountOverflow = errors.New("data channel buffered more data than the maximum amount")
 
 func (s *stream) Write(b []byte) (int, error) {
 	s.mx.Lock()
 	defer s.mx.Unlock()
 
-	if s.closeForShutdownErr != nil {
-		return 0, s.closeForShutdownErr
-	}
-	switch s.sendState {
-	case sendStateReset:
-		return 0, network.ErrReset
-	case sendStateDataSent, sendStateDataReceived:
-		return 0, errWriteAfterClose
-	}
+	bufs := [1][]byte{b}
+	return s.write(context.Background(), bufs[:], false)
+}
+
+// WriteString implements io.StringWriter. It writes s on the stream like Write, without
+// copying s to a byte slice first.
+func (s *stream) WriteString(str string) (int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	// The data is only read, and isn't referenced after write returns.
+	bufs := [1][]byte{unsafe.Slice(unsafe.StringData(str), len(str))}
+	return s.write(context.Background(), bufs[:], false)
+}
+
+// WriteContext writes b on the stream, like Write. In addition to the write deadline, a write
+// blocked waiting for space on the send buffer is also interrupted when ctx is cancelled.
+// In that case the returned error wraps ctx.Err().
+func (s *stream) WriteContext(ctx context.Context, b []byte) (int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	bufs := [1][]byte{b}
+	return s.write(ctx, bufs[:], false)
+}
+
+// WriteBuffers writes the contents of bufs to the stream, in order. In contrast to calling
+// Write for every buffer, the data is coalesced into as few messages as possible, saving the
+// per message overhead when writing many small buffers.
+//
+// It returns the total number of bytes written from all buffers.
+func (s *stream) WriteBuffers(bufs [][]byte) (int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.write(context.Background(), bufs, false)
+}
+
+// WriteMessages writes every payload in payloads on the stream, in order. Payloads never share
+// a message, but like Write, a payload is split across several messages if it's larger than the
+// maximum message size, or if only part of it fits on the send buffer. The result is the same
+// as calling Write for every payload, except that no concurrent writer can send data on the
+// stream until WriteMessages returns, even though WriteMessages might have to wait for space on
+// the send buffer in between.
+//
+// It returns the total number of bytes written from all payloads. On error, this includes the
+// bytes from payloads that were fully written, and the bytes already written from the payload
+// that failed.
+func (s *stream) WriteMessages(payloads [][]byte) (int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
 
+	if err := s.checkSendState(); err != nil {
+		return 0, err
+	}
 	if !s.writeDeadline.IsZero() && time.Now().After(s.writeDeadline) {
-		return 0, os.ErrDeadlineExceeded
+		return 0, s.writeDeadlineExceeded()
+	}
+	// wait for concurrent WriteMessages calls to finish
+	var timer deadlineTimer
+	defer timer.stop()
+	for s.writeMessagesDone != nil {
+		if err := s.waitWriteStateChanged(context.Background(), &timer, s.writeMessagesDone, nil); err != nil {
+			return 0, err
+		}
+		if err := s.checkSendState(); err != nil {
+			return 0, err
+		}
 	}
 
-	var writeDeadlineTimer *time.Timer
+	done := make(chan struct{})
+	s.writeMessagesDone = done
 	defer func() {
-		if writeDeadlineTimer != nil {
-			writeDeadlineTimer.Stop()
-		}
+		s.writeMessagesDone = nil
+		close(done)
 	}()
 
+	var n int
+	for _, p := range payloads {
+		bufs := [1][]byte{p}
+		nw, err := s.write(context.Background(), bufs[:], true)
+		n += nw
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// write writes the contents of bufs to the data channel, waiting for space on the send buffer,
+// and respecting the write deadline and ctx. Data from consecutive buffers is coalesced into a
+// single message, up to the maximum message size.
+// If inWriteMessages is false, write waits for a concurrent WriteMessages call to finish before
+// writing any data.
+// It needs to be called while the mutex is locked.
+func (s *stream) write(ctx context.Context, bufs [][]byte, inWriteMessages bool) (int, error) {
+	if err := s.config.checkMessageSizes(); err != nil {
+		return 0, err
+	}
+	// Check the state before looking at the data, so that zero-length writes on a closed or
+	// reset stream return an error. Zero-length writes never send a message.
+	if err := s.checkSendState(); err != nil {
+		return 0, err
+	}
+	if !s.writeDeadline.IsZero() && time.Now().After(s.writeDeadline) {
+		return 0, s.writeDeadlineExceeded()
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("write cancelled: %w", err)
+	}
+
+	// The timer is only armed when we have to wait for space on the send buffer.
+	var timer deadlineTimer
+	defer timer.stop()
+	var reserving bool
+
 	var n int
 	var msg pb.Message
-	for len(b) > 0 {
-		if s.closeForShutdownErr != nil {
-			return n, s.closeForShutdownErr
+	// scratch is used for coalescing data from multiple buffers into a single message.
+	// It's only allocated if needed.
+	var scratch []byte
+	// off is the offset of the unwritten data in bufs[0]
+	var off int
+	// queued is our queued write, once we had to wait for space on the send buffer. From then
+	// on, our data is sent together with the data of the other queued writes.
+	var queued *queuedWrite
+	queue := func() {
+		if queued != nil || inWriteMessages {
+			return
 		}
-		switch s.sendState {
-		case sendStateReset:
-			return n, network.ErrReset
-		case sendStateDataSent, sendStateDataReceived:
-			return n, errWriteAfterClose
-		}
-
-		writeDeadline := s.writeDeadline
-		// deadline deleted, stop and remove the timer
-		if writeDeadline.IsZero() && writeDeadlineTimer != nil {
-			writeDeadlineTimer.Stop()
-			writeDeadlineTimer = nil
-		}
-		var writeDeadlineChan <-chan time.Time
-		if !writeDeadline.IsZero() {
-			if writeDeadlineTimer == nil {
-				writeDeadlineTimer = time.NewTimer(time.Until(writeDeadline))
-			} else {
-				if !writeDeadlineTimer.Stop() {
-					<-writeDeadlineTimer.C
-				}
-				writeDeadlineTimer.Reset(time.Until(writeDeadline))
+		queued = s.queueWrite(bufs, off, n)
+	}
+	// result returns the result of the write, after it failed with err
+	result := func(err error) (int, error) {
+		if queued == nil {
+			return n, err
+		}
+		if queued.isDone() {
+			// our data might have been sent while we were failing
+			return queued.n, queued.err
+		}
+		s.dequeueWrite(queued)
+		return queued.n, err
+	}
+	for {
+		// Load the version before checking the write state, so that we don't miss any change
+		// after the checks.
+		version := s.loadWriteStateVersion()
+		if queued != nil {
+			if queued.isDone() {
+				return queued.n, queued.err
 			}
-			writeDeadlineChan = writeDeadlineTimer.C
+		} else {
+			for len(bufs) > 0 && off == len(bufs[0]) {
+				bufs = bufs[1:]
+				off = 0
+			}
+			if len(bufs) == 0 {
+				break
+			}
+		}
+		if err := s.checkSendState(); err != nil {
+			return result(err)
+		}
+		// Don't interleave our messages with the messages of a concurrent WriteMessages call.
+		if s.writeMessagesDone != nil && !inWriteMessages {
+			if err := s.waitWriteStateChanged(ctx, &timer, s.writeMessagesDone, nil); err != nil {
+				return result(err)
+			}
+			continue
+		}
+		// Don't overtake writes waiting for space.
+		if len(s.writeQueue) > 0 {
+			queue()
 		}
 
-		availableSpace := s.availableSendSpace()
-		if availableSpace < minMessageSize {
-			s.mx.Unlock()
-			select {
-			case <-writeDeadlineChan:
-				s.mx.Lock()
-				return n, os.ErrDeadlineExceeded
-			case <-s.writeStateChanged:
+		availableSpace, err := s.availableSendSpace()
+		if err != nil {
+			return result(err)
+		}
+		if availableSpace < s.config.minMessageSize {
+			queue()
+			s.writeStats.Stalls++
+			if err := s.waitWriteStateChanged(ctx, &timer, s.writeStateChangedSince(version), queuedDone(queued)); err != nil {
+				return result(err)
 			}
-			s.mx.Lock()
 			continue
 		}
-		end := maxMessageSize
+		end := s.config.maxMessageSize
 		if end > availableSpace {
 			end = availableSpace
 		}
+		// Reserve space on the send budget of the connection, shared with the other streams.
+		var reserved int
+		if budget := s.config.sendBudget; budget != nil {
+			if !reserving {
+				reserving = true
+				// don't keep space reserved, or keep waiting for space, once we return
+				defer budget.cancel(s)
+			}
+			reserved = budget.reserve(s, s.config.minMessageSize, end)
+			if reserved == 0 {
+				queue()
+				s.writeStats.Stalls++
+				if err := s.waitWriteStateChanged(ctx, &timer, s.writeStateChangedSince(version), queuedDone(queued)); err != nil {
+					return result(err)
+				}
+				continue
+			}
+			if end > reserved {
+				end = reserved
+			}
+		}
 		end -= protoOverhead + varintOverhead
-		if end > len(b) {
-			end = len(b)
+
+		var payload []byte
+		if queued != nil {
+			payload = s.queuedPayload(end, &scratch)
+		} else if len(bufs[0])-off >= end || len(bufs) == 1 {
+			// no need to copy if the message only contains data from a single buffer
+			payload = bufs[0][off:]
+			if len(payload) > end {
+				payload = payload[:end]
+			}
+			off += len(payload)
+		} else {
+			if scratch == nil {
+				scratch = make([]byte, s.config.maxMessageSize)
+			}
+			payload = scratch[:0]
+			for len(bufs) > 0 && len(payload) < end {
+				c := copy(scratch[len(payload):end], bufs[0][off:])
+				payload = scratch[:len(payload)+c]
+				off += c
+				if off == len(bufs[0]) {
+					bufs = bufs[1:]
+					off = 0
+				}
+			}
 		}
-		msg = pb.Message{Message: b[:end]}
-		if err := s.writer.WriteMsg(&msg); err != nil {
-			return n, err
+		msg = pb.Message{Message: payload}
+		err = s.writer.WriteMsg(&msg)
+		if s.config.sendBudget != nil {
+			written := 0
+			if err == nil {
+				written = len(payload) + protoOverhead + varintOverhead
+			}
+			s.config.sendBudget.commit(s, reserved, written)
+		}
+		if queued != nil {
+			s.completeQueuedWrites(err)
+		}
+		if err != nil {
+			return result(err)
 		}
-		n += end
-		b = b[end:]
+		if queued == nil {
+			n += len(payload)
+		}
+		s.writeStats.BytesWritten += uint64(len(payload))
+		s.writeStats.Messages++
 	}
 	return n, nil
 }
 
+// queuedDone returns the channel closed once the data of w was sent, or nil if w is nil.
+func queuedDone(w *queuedWrite) <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	return w.done
+}
+
+// StreamWriteStats are statistics about the data written on a stream.
+type StreamWriteStats struct {
+	// BytesWritten is the number of bytes written on the stream, excluding message overhead.
+	BytesWritten uint64
+	// Messages is the number of messages carrying data, that were written on the stream.
+	Messages uint64
+	// Stalls is the number of times a write had to wait for space on the send buffer, or on
+	// the send budget of the connection.
+	Stalls uint64
+	// Wakeups is the number of times a waiting write was woken up, excluding deadlines and
+	// cancellations.
+	Wakeups uint64
+}
+
+// WriteStats returns statistics about the data written on the stream.
+func (s *stream) WriteStats() StreamWriteStats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.writeStats
+}
+
+// ReadFrom implements io.ReaderFrom. It reads from r directly into buffers sized to fit
+// the next message on the data channel, so that io.Copy to a stream doesn't need an
+// intermediate buffer. The semantics, including the returned errors, are the same as
+// calling Write with the data read from r.
+func (s *stream) ReadFrom(r io.Reader) (int64, error) {
+	if err := s.config.checkMessageSizes(); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, s.config.maxMessageSize-protoOverhead-varintOverhead)
+	var n int64
+	for {
+		s.mx.Lock()
+		if err := s.checkSendState(); err != nil {
+			s.mx.Unlock()
+			return n, err
+		}
+		if !s.writeDeadline.IsZero() && time.Now().After(s.writeDeadline) {
+			err := s.writeDeadlineExceeded()
+			s.mx.Unlock()
+			return n, err
+		}
+		// Read only as much as we can send right away, so that in the common case
+		// every read from r results in exactly one message.
+		availableSpace, err := s.availableSendSpace()
+		if err != nil {
+			s.mx.Unlock()
+			return n, err
+		}
+		size := len(buf)
+		if availableSpace >= s.config.minMessageSize && availableSpace-protoOverhead-varintOverhead < size {
+			size = availableSpace - protoOverhead - varintOverhead
+		}
+		s.mx.Unlock()
+
+		nr, rerr := r.Read(buf[:size])
+		if nr > 0 {
+			nw, err := s.Write(buf[:nr])
+			n += int64(nw)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// checkSendState returns an error if no more data can be written on the stream.
+// It needs to be called while the mutex is locked.
+func (s *stream) checkSendState() error {
+	if s.closeForShutdownErr != nil {
+		return s.closeForShutdownErr
+	}
+	switch s.sendState {
+	case sendStateReset:
+		return network.ErrReset
+	case sendStateDataSent, sendStateDataReceived:
+		return ErrWriteAfterClose
+	}
+	return nil
+}
+
+// expiredWriteDeadlineSlack is the amount of time a write deadline can already be expired when
+// it's set, before writes failing on it are logged. Deadlines that far in the past are usually
+// a bug, e.g. a deadline derived from the zero time.
+const expiredWriteDeadlineSlack = time.Minute
+
 func (s *stream) SetWriteDeadline(t time.Time) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
+	changed := !t.Equal(s.writeDeadline)
 	s.writeDeadline = t
-	s.notifyWriteStateChanged()
+	s.writeDeadlineExpiredOnSet = !t.IsZero() && time.Since(t) > expiredWriteDeadlineSlack
+	if changed {
+		s.notifyWriteStateChanged()
+	}
 	return nil
 }
 
-func (s *stream) availableSendSpace() int {
+// writeDeadlineExceeded returns the error for a write that failed since the write deadline
+// expired, logging writes that fail on a deadline that was already expired long before it was
+// set.
+// It needs to be called while the mutex is locked.
+func (s *stream) writeDeadlineExceeded() error {
+	if s.writeDeadlineExpiredOnSet {
+		log.Debugw("write failed on a write deadline that was already expired when it was set",
+			"stream", s.id, "deadline", s.writeDeadline)
+	}
+	return os.ErrDeadlineExceeded
+}
+
+// BufferedAmount returns the amount of data written on the stream that is still buffered on
+// the data channel, waiting to be sent out by the SCTP layer.
+func (s *stream) BufferedAmount() uint64 {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.dataChannel.BufferedAmount()
+}
+
+// AvailableSendSpace returns the amount of data that can be written on the stream without
+// blocking, including the message overhead. It's the same value Write uses to decide whether
+// it needs to wait for space on the send buffer. It doesn't account for the send budget of
+// the connection.
+func (s *stream) AvailableSendSpace() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	availableSpace, err := s.availableSendSpace()
+	if err != nil || availableSpace < 0 {
+		return 0
+	}
+	return availableSpace
+}
+
+// availableSendSpace returns the space available on the send buffer of the data channel.
+// It returns errBufferedAmountOverflow if more data is buffered than we ever enqueue.
+func (s *stream) availableSendSpace() (int, error) {
 	buffered := int(s.dataChannel.BufferedAmount())
-	availableSpace := maxSendBuffer - buffered
+	availableSpace := s.config.maxSendBuffer - buffered
 	if availableSpace+maxTotalControlMessagesSize < 0 { // this should never happen, but better check
-		log.Errorw("data channel buffered more data than the maximum amount", "max", maxSendBuffer, "buffered", buffered)
+		s.reportAnomaly(StreamAnomaly{
+			Message:       "data channel buffered more data than the maximum amount",
+			MaxSendBuffer: s.config.maxSendBuffer,
+			Buffered:      uint64(buffered),
+		})
+		return 0, errBufferedAmountOverflow
 	}
-	return availableSpace
+	return availableSpace, nil
+}
+
+// reportAnomaly reports a to the anomaly handler, or logs it if there's no handler.
+func (s *stream) reportAnomaly(a StreamAnomaly) {
+	a.StreamID = s.id
+	if s.config.anomalyHandler != nil {
+		s.config.anomalyHandler(a)
+		return
+	}
+	log.Errorw(a.Message, "stream", a.StreamID, "max", a.MaxSendBuffer, "buffered", a.Buffered)
 }
 
-func (s *stream) cancelWrite() error {
+func (s *stream) cancelWrite(errCode uint32) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
 
@@ -128,11 +471,15 @@ func (s *stream) cancelWrite() error {
 	if s.sendState == sendStateDataReceived || s.sendState == sendStateReset {
 		return nil
 	}
-	s.sendState = sendStateReset
+	s.setSendState(sendStateReset)
+	s.setResetErr(&StreamResetError{ErrorCode: errCode, Cause: ResetCauseLocal})
 	s.notifyWriteStateChanged()
-	if err := s.writer.WriteMsg(&pb.Message{Flag: pb.Message_RESET.Enum()}); err != nil {
+	if err := s.writer.WriteMsg(&pb.Message{Flag: pb.Message_RESET.Enum(), ErrorCode: &errCode}); err != nil {
 		return err
 	}
+	if s.config.metricsTracer != nil {
+		s.config.metricsTracer.FlagSent(pb.Message_RESET)
+	}
 	return nil
 }
 
@@ -143,17 +490,294 @@ func (s *stream) CloseWrite() error {
 	if s.sendState != sendStateSending {
 		return nil
 	}
-	s.sendState = sendStateDataSent
+	s.setSendState(sendStateDataSent)
 	s.notifyWriteStateChanged()
 	if err := s.writer.WriteMsg(&pb.Message{Flag: pb.Message_FIN.Enum()}); err != nil {
 		return err
 	}
+	if s.config.metricsTracer != nil {
+		s.config.metricsTracer.FlagSent(pb.Message_FIN)
+	}
 	return nil
 }
 
-func (s *stream) notifyWriteStateChanged() {
+// setSendState transitions the send side of the stream to state, and records the transition
+// with the metrics tracer. It does nothing if the send side already is in state, e.g. when the
+// peer sends a FIN_ACK twice.
+// It needs to be called while the mutex is locked.
+func (s *stream) setSendState(state sendState) {
+	if s.sendState == state {
+		return
+	}
+	if mt := s.config.metricsTracer; mt != nil {
+		// The send side of a stream that was shut down was already accounted as closed.
+		if s.sendState == sendStateSending && s.closeForShutdownErr == nil {
+			mt.SendSideClosed()
+		}
+		mt.SendStateChanged(state.String())
+	}
+	s.sendState = state
+}
+
+// CloseWriteWithTimeout closes the write half of the stream like CloseWrite, and then waits
+// for the peer to acknowledge the receipt of all data written on the stream. It returns
+// os.ErrDeadlineExceeded if the acknowledgement isn't received within d, and network.ErrReset
+// if the send side of the stream is reset while waiting.
+//
+// If no Read call is in progress and the read half of the stream isn't closed, it reads the
+// acknowledgement from the stream itself, so that a request can be sent and acknowledged before
+// the response is read. Data received in the meantime is kept for the next Read. Only a single
+// message can be kept, so if the peer sends data before acknowledging, the acknowledgement is
+// only processed by reading from the stream. A Read called while waiting isn't blocked by this,
+// it takes over reading from the stream.
+func (s *stream) CloseWriteWithTimeout(d time.Duration) error {
+	if err := s.CloseWrite(); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for {
+		version := s.loadWriteStateVersion()
+		if s.closeForShutdownErr != nil {
+			return s.closeForShutdownErr
+		}
+		switch s.sendState {
+		case sendStateDataReceived:
+			return nil
+		case sendStateReset:
+			return network.ErrReset
+		}
+		// Otherwise, a concurrent Read or the control message reader processes the FIN_ACK.
+		var readerDone <-chan struct{}
+		if s.receiveState == receiveStateReceiving && s.nextMessage == nil {
+			if s.readers == 0 && s.readerMx.TryLock() {
+				if err := s.readFINACK(deadline); err != nil {
+					return err
+				}
+				continue
+			}
+			// Read the FIN_ACK once the concurrent Read returns without having read it.
+			if s.readerDone == nil {
+				s.readerDone = make(chan struct{})
+			}
+			readerDone = s.readerDone
+		}
+		stateChanged := s.writeStateChangedSince(version)
+		s.mx.Unlock()
+		select {
+		case <-timer.C:
+			s.mx.Lock()
+			return os.ErrDeadlineExceeded
+		case <-stateChanged:
+		case <-readerDone:
+		}
+		s.mx.Lock()
+	}
+}
+
+// Flush blocks until all data written on the stream has been sent out by the SCTP layer, i.e.
+// until the buffered amount on the data channel drops to zero.
+// It returns network.ErrReset if the send side of the stream is reset while flushing.
+func (s *stream) Flush(ctx context.Context) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	// Lower the threshold so that we're notified once all data has been sent. We don't rely on
+	// timers here, since the buffered amount can only change by sending data.
+	s.holdLowThreshold()
+	defer s.releaseLowThreshold()
+
+	for {
+		version := s.loadWriteStateVersion()
+		if s.closeForShutdownErr != nil {
+			return s.closeForShutdownErr
+		}
+		if s.sendState == sendStateReset {
+			return network.ErrReset
+		}
+		if s.dataChannel.BufferedAmount() == 0 {
+			return nil
+		}
+		stateChanged := s.writeStateChangedSince(version)
+		s.mx.Unlock()
+		select {
+		case <-ctx.Done():
+			s.mx.Lock()
+			return ctx.Err()
+		case <-stateChanged:
+		}
+		s.mx.Lock()
+	}
+}
+
+// waitWriteStateChanged releases the mutex and waits until changed or sent is closed, the write
+// deadline is reached, or ctx is cancelled. changed is usually the channel returned from
+// writeStateChangedSince. sent might be nil.
+// It returns os.ErrDeadlineExceeded if the deadline was reached, and an error wrapping
+// ctx.Err() if ctx was cancelled. timer is armed with the write deadline, if any.
+// It needs to be called while the mutex is locked, and returns with the mutex locked.
+func (s *stream) waitWriteStateChanged(ctx context.Context, timer *deadlineTimer, changed, sent <-chan struct{}) error {
+	deadlineChan := timer.arm(s.writeDeadline)
+	s.mx.Unlock()
 	select {
-	case s.writeStateChanged <- struct{}{}:
-	default:
+	case <-deadlineChan:
+		s.mx.Lock()
+		// The deadline might have been extended while we were waiting.
+		if !s.writeDeadline.IsZero() && !time.Now().Before(s.writeDeadline) {
+			return s.writeDeadlineExceeded()
+		}
+		timer.fired()
+		return nil
+	case <-ctx.Done():
+		s.mx.Lock()
+		return fmt.Errorf("write cancelled: %w", ctx.Err())
+	case <-changed:
+	case <-sent:
+	}
+	s.mx.Lock()
+	s.writeStats.Wakeups++
+	return nil
+}
+
+// holdLowThreshold lowers the buffered amount low threshold of the data channel to 0, so that
+// we're notified once all data has been sent, until releaseLowThreshold is called.
+func (s *stream) holdLowThreshold() {
+	s.thresholdMx.Lock()
+	defer s.thresholdMx.Unlock()
+	if s.lowThresholdHolds == 0 {
+		s.dataChannel.SetBufferedAmountLowThreshold(0)
+	}
+	s.lowThresholdHolds++
+}
+
+// releaseLowThreshold restores the configured buffered amount low threshold, once every
+// holdLowThreshold call has been released.
+func (s *stream) releaseLowThreshold() {
+	s.thresholdMx.Lock()
+	defer s.thresholdMx.Unlock()
+	s.lowThresholdHolds--
+	if s.lowThresholdHolds == 0 {
+		s.dataChannel.SetBufferedAmountLowThreshold(uint64(s.config.sendBufferLowThreshold))
+		// The buffered amount might have dropped below the configured threshold while it was
+		// lowered. Writers waiting for that won't be notified anymore.
+		s.notifyWriteStateChanged()
+	}
+}
+
+// notifyWriteStateChanged wakes up all goroutines waiting for a change of the write state, i.e.
+// of the send state, the write deadline, or the space available for writing.
+func (s *stream) notifyWriteStateChanged() {
+	s.writeStateMx.Lock()
+	defer s.writeStateMx.Unlock()
+	s.writeStateVersion++
+	if s.writeStateChanged != nil {
+		close(s.writeStateChanged)
+		s.writeStateChanged = nil
+	}
+}
+
+// loadWriteStateVersion returns the current version of the write state. It's loaded before
+// checking the write state, so that a waiter doesn't miss changes after the checks.
+func (s *stream) loadWriteStateVersion() uint64 {
+	s.writeStateMx.Lock()
+	defer s.writeStateMx.Unlock()
+	return s.writeStateVersion
+}
+
+// closedChan is an always closed channel.
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// writeStateChangedSince returns a channel that is closed once the write state changes after
+// version. If it already changed, the returned channel is closed. Waiters are only woken up by
+// actual changes, and every waiter is woken up by every change.
+func (s *stream) writeStateChangedSince(version uint64) <-chan struct{} {
+	s.writeStateMx.Lock()
+	defer s.writeStateMx.Unlock()
+	if s.writeStateVersion != version {
+		return closedChan
+	}
+	if s.writeStateChanged == nil {
+		s.writeStateChanged = make(chan struct{})
+	}
+	return s.writeStateChanged
+}
+
+// deadlineTimer is a timer for the write deadline. The timer is taken from the pool when it's
+// first armed, and only reset when the deadline changes.
+type deadlineTimer struct {
+	timer    *time.Timer
+	deadline time.Time
+}
+
+// arm returns a channel firing at deadline. If deadline is zero, it returns nil. The timer
+// isn't stopped in that case, it's stopped when it's returned to the pool.
+func (t *deadlineTimer) arm(deadline time.Time) <-chan time.Time {
+	if deadline.IsZero() {
+		return nil
+	}
+	if t.timer == nil {
+		t.timer = getTimer(time.Until(deadline))
+	} else if !deadline.Equal(t.deadline) {
+		resetTimer(t.timer, time.Until(deadline))
+	}
+	t.deadline = deadline
+	return t.timer.C
+}
+
+// fired records that the timer fired, so that it is reset by the next call to arm.
+func (t *deadlineTimer) fired() {
+	t.deadline = time.Time{}
+}
+
+// stop returns the timer to the pool.
+func (t *deadlineTimer) stop() {
+	if t.timer != nil {
+		putTimer(t.timer)
+		t.timer = nil
+	}
+}
+
+// timerPool is a pool of timers used for write deadlines. Reusing timers avoids allocating a
+// new timer for every write that has to wait for space on the send buffer.
+var timerPool sync.Pool
+
+// getTimer returns a timer from the pool, firing after d.
+func getTimer(d time.Duration) *time.Timer {
+	if t, ok := timerPool.Get().(*time.Timer); ok {
+		t.Reset(d)
+		return t
+	}
+	return time.NewTimer(d)
+}
+
+// putTimer stops t and returns it to the pool. t must not be used afterwards.
+func putTimer(t *time.Timer) {
+	stopTimer(t)
+	timerPool.Put(t)
+}
+
+// resetTimer resets t to fire after d, discarding any pending expiration.
+func resetTimer(t *time.Timer, d time.Duration) {
+	stopTimer(t)
+	t.Reset(d)
+}
+
+// stopTimer stops t and drains its channel, if the timer fired and the expiration
+// hasn't been consumed yet.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
 	}
 }
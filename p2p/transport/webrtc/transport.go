@@ -96,12 +96,103 @@ type WebRTCTransport struct {
 
 	// in-flight connections
 	maxInFlightConnections uint32
+
+	streamConfig streamConfig
+	// sendBufferLowThreshold is the configured send buffer low threshold, or -1 if the
+	// threshold is derived from the other stream settings.
+	sendBufferLowThreshold int
+	// connectionSendBuffer is the maximum amount of data all streams of a connection enqueue
+	// together, or 0 if it isn't limited.
+	connectionSendBuffer int
 }
 
 var _ tpt.Transport = &WebRTCTransport{}
 
 type Option func(*WebRTCTransport) error
 
+// WithStreamWriteBuffer sets the maximum amount of data a single stream enqueues on the
+// underlying data channel. Writes block until the peer has consumed enough of the enqueued data.
+// Smaller values reduce the memory usage per stream, larger values increase throughput on
+// high latency connections.
+func WithStreamWriteBuffer(max int) Option {
+	return func(t *WebRTCTransport) error {
+		if max <= 0 {
+			return fmt.Errorf("stream write buffer must be positive: %d", max)
+		}
+		t.streamConfig.maxSendBuffer = max
+		return nil
+	}
+}
+
+// WithSendBufferLowThreshold sets the threshold for a stream's write buffer, below which
+// writes blocked on a full write buffer are resumed. Lower values result in fewer, but larger
+// messages, higher values keep more data enqueued on the data channel.
+// It must not be larger than the stream write buffer minus the min message size.
+//
+// By default, writes are resumed as soon as there's space for a maximum sized message.
+func WithSendBufferLowThreshold(n int) Option {
+	return func(t *WebRTCTransport) error {
+		if n < 0 {
+			return fmt.Errorf("send buffer low threshold must not be negative: %d", n)
+		}
+		t.sendBufferLowThreshold = n
+		return nil
+	}
+}
+
+// WithMinMessageSize sets the minimum amount of space required on a stream's write buffer
+// before a new message is sent. If less space is available, writes block until more space
+// opens up. It must not be larger than the stream write buffer.
+func WithMinMessageSize(n int) Option {
+	return func(t *WebRTCTransport) error {
+		if n <= protoOverhead+varintOverhead {
+			return fmt.Errorf("min message size must be larger than the message overhead of %d bytes: %d", protoOverhead+varintOverhead, n)
+		}
+		if n > maxMessageSize {
+			return fmt.Errorf("min message size must not exceed the max message size of %d bytes: %d", maxMessageSize, n)
+		}
+		t.streamConfig.minMessageSize = n
+		return nil
+	}
+}
+
+// WithConnectionSendBuffer limits the total amount of data all streams of a connection enqueue
+// on the underlying SCTP association to max. Without a limit, every stream enqueues up to the
+// stream write buffer, so many concurrent streams increase the latency for all streams.
+// Streams waiting for space on the connection's send buffer take turns, so that a single
+// stream can't starve the others. It must not be smaller than the min message size.
+//
+// By default, the total amount of data isn't limited.
+func WithConnectionSendBuffer(max int) Option {
+	return func(t *WebRTCTransport) error {
+		if max <= 0 {
+			return fmt.Errorf("connection send buffer must be positive: %d", max)
+		}
+		t.connectionSendBuffer = max
+		return nil
+	}
+}
+
+// WithMetricsTracer uses mt to track the state of the send side of streams. By default, no
+// metrics are collected.
+func WithMetricsTracer(mt MetricsTracer) Option {
+	return func(t *WebRTCTransport) error {
+		t.streamConfig.metricsTracer = mt
+		return nil
+	}
+}
+
+// WithAnomalyHandler passes the anomalies detected on streams to h, instead of logging them.
+// Anomalies are invariant violations, like a data channel buffering more data than the stream
+// ever enqueues. h is called while the stream is locked, so it must not block, and it must not
+// call any methods of the stream.
+func WithAnomalyHandler(h func(StreamAnomaly)) Option {
+	return func(t *WebRTCTransport) error {
+		t.streamConfig.anomalyHandler = h
+		return nil
+	}
+}
+
 type iceTimeouts struct {
 	Disconnect time.Duration
 	Failed     time.Duration
@@ -158,12 +249,28 @@ func New(privKey ic.PrivKey, psk pnet.PSK, gater connmgr.ConnectionGater, rcmgr
 		},
 
 		maxInFlightConnections: DefaultMaxInFlightConnections,
+
+		streamConfig:           defaultStreamConfig,
+		sendBufferLowThreshold: -1,
 	}
 	for _, opt := range opts {
 		if err := opt(transport); err != nil {
 			return nil, err
 		}
 	}
+	streamCfg := &transport.streamConfig
+	if transport.sendBufferLowThreshold >= 0 {
+		streamCfg.sendBufferLowThreshold = transport.sendBufferLowThreshold
+	} else {
+		streamCfg.sendBufferLowThreshold = defaultSendBufferLowThreshold(streamCfg.maxMessageSize, streamCfg.maxSendBuffer, streamCfg.minMessageSize)
+	}
+	if err := streamCfg.validate(); err != nil {
+		return nil, err
+	}
+	if transport.connectionSendBuffer > 0 && transport.connectionSendBuffer < streamCfg.minMessageSize {
+		return nil, fmt.Errorf("connection send buffer (%d) must not be smaller than the min message size (%d)",
+			transport.connectionSendBuffer, streamCfg.minMessageSize)
+	}
 	return transport, nil
 }
 
@@ -272,14 +379,10 @@ func (t *WebRTCTransport) dial(ctx context.Context, scope network.ConnManagement
 		}
 	}()
 
-	remoteMultihash, err := decodeRemoteFingerprint(remoteMultiaddr)
+	remoteMultihash, remoteHashFunction, err := decodeRemoteFingerprint(remoteMultiaddr)
 	if err != nil {
 		return nil, fmt.Errorf("decode fingerprint: %w", err)
 	}
-	remoteHashFunction, ok := getSupportedSDPHash(remoteMultihash.Code)
-	if !ok {
-		return nil, fmt.Errorf("unsupported hash function: %w", nil)
-	}
 
 	rnw, rhost, err := manet.DialArgs(remoteMultiaddr)
 	if err != nil {
@@ -365,7 +468,7 @@ func (t *WebRTCTransport) dial(ctx context.Context, scope network.ConnManagement
 	if err != nil {
 		return nil, err
 	}
-	channel := newStream(w.HandshakeDataChannel, detached, func() {})
+	channel := newStream(w.HandshakeDataChannel, detached, t.handshakeStreamConfig(), func() {})
 
 	remotePubKey, err := t.noiseHandshake(ctx, w.PeerConnection, channel, p, remoteHashFunction, false)
 	if err != nil {
@@ -455,7 +558,7 @@ func (t *WebRTCTransport) generateNoisePrologue(pc *webrtc.PeerConnection, hash
 		return nil, err
 	}
 
-	localFpBytes, err := decodeInterspersedHexFromASCIIString(localFp.Value)
+	localFpBytes, err := decodeInterspersedHexStrict(localFp.Value)
 	if err != nil {
 		return nil, err
 	}
@@ -482,6 +585,15 @@ func (t *WebRTCTransport) generateNoisePrologue(pc *webrtc.PeerConnection, hash
 	return result, nil
 }
 
+// handshakeStreamConfig returns the configuration of the stream used for the noise handshake.
+// The handshake stream isn't a libp2p stream, and isn't closed after a successful handshake, so
+// it isn't tracked by the metrics tracer.
+func (t *WebRTCTransport) handshakeStreamConfig() streamConfig {
+	config := t.streamConfig
+	config.metricsTracer = nil
+	return config
+}
+
 func (t *WebRTCTransport) noiseHandshake(ctx context.Context, pc *webrtc.PeerConnection, s *stream, peer peer.ID, hash crypto.Hash, inbound bool) (ic.PubKey, error) {
 	prologue, err := t.generateNoisePrologue(pc, hash, inbound)
 	if err != nil {
@@ -3,6 +3,7 @@ package libp2pwebrtc
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -21,6 +22,7 @@ import (
 	manet "github.com/multiformats/go-multiaddr/net"
 	"github.com/multiformats/go-multibase"
 	"github.com/multiformats/go-multihash"
+	"github.com/pion/datachannel"
 	quicproxy "github.com/quic-go/quic-go/integrationtests/tools/proxy"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -96,7 +98,50 @@ func TestTransportWebRTC_DialFailsOnUnsupportedHashFunction(t *testing.T) {
 	testaddr, err := ma.NewMultiaddr("/ip4/1.2.3.4/udp/1234/webrtc-direct/certhash/" + certhash)
 	require.NoError(t, err)
 	_, err = tr.Dial(context.Background(), testaddr, "")
-	require.ErrorContains(t, err, "unsupported hash function")
+	require.ErrorIs(t, err, errUnsupportedCertHash)
+	require.ErrorContains(t, err, "sha3-512")
+}
+
+func TestDecodeRemoteFingerprint(t *testing.T) {
+	digest, err := hex.DecodeString("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	require.NoError(t, err)
+	certhash := func(digest []byte, code uint64) ma.Multiaddr {
+		t.Helper()
+		encoded, err := multihash.Encode(digest, code)
+		require.NoError(t, err)
+		certhash, err := multibase.Encode(multibase.Base64url, encoded)
+		require.NoError(t, err)
+		return ma.StringCast("/ip4/1.2.3.4/udp/1234/webrtc-direct/certhash/" + certhash)
+	}
+
+	decoded, hash, err := decodeRemoteFingerprint(certhash(digest, multihash.SHA2_256))
+	require.NoError(t, err)
+	require.Equal(t, "SHA-256", hash.String())
+	require.Equal(t, uint64(multihash.SHA2_256), decoded.Code)
+	require.Equal(t, digest, decoded.Digest)
+
+	sha512Digest := sha512.Sum512([]byte("test-data"))
+	_, hash, err = decodeRemoteFingerprint(certhash(sha512Digest[:], multihash.SHA2_512))
+	require.NoError(t, err)
+	require.Equal(t, "SHA-512", hash.String())
+
+	t.Run("truncated digest", func(t *testing.T) {
+		_, _, err := decodeRemoteFingerprint(certhash(digest[:20], multihash.SHA2_256))
+		require.ErrorIs(t, err, errUnsupportedCertHash)
+		require.ErrorContains(t, err, "digest length of 20 bytes, expected 32 bytes")
+	})
+
+	t.Run("unsupported hash function", func(t *testing.T) {
+		_, _, err := decodeRemoteFingerprint(certhash(digest, multihash.SHA3_256))
+		require.ErrorIs(t, err, errUnsupportedCertHash)
+		require.ErrorContains(t, err, "sha3-256")
+	})
+
+	t.Run("unknown hash function", func(t *testing.T) {
+		_, _, err := decodeRemoteFingerprint(certhash(digest, 0x300000))
+		require.ErrorIs(t, err, errUnsupportedCertHash)
+		require.ErrorContains(t, err, "unsupported hash function 0x300000")
+	})
 }
 
 func TestTransportWebRTC_CanListenSingle(t *testing.T) {
@@ -140,6 +185,53 @@ func WithListenerMaxInFlightConnections(m uint32) Option {
 	}
 }
 
+func TestTransportWebRTC_StreamConfigOptions(t *testing.T) {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	newTransport := func(opts ...Option) (*WebRTCTransport, error) {
+		return New(privKey, nil, nil, &network.NullResourceManager{}, opts...)
+	}
+
+	tr, err := newTransport()
+	require.NoError(t, err)
+	require.Equal(t, defaultStreamConfig, tr.streamConfig)
+
+	tr, err = newTransport(WithStreamWriteBuffer(4096), WithMinMessageSize(2048))
+	require.NoError(t, err)
+	require.Equal(t, streamConfig{maxMessageSize: maxMessageSize, maxSendBuffer: 4096, minMessageSize: 2048, sendBufferLowThreshold: 2048}, tr.streamConfig)
+
+	tr, err = newTransport(WithStreamWriteBuffer(1<<20), WithSendBufferLowThreshold(0))
+	require.NoError(t, err)
+	require.Equal(t, streamConfig{maxMessageSize: maxMessageSize, maxSendBuffer: 1 << 20, minMessageSize: defaultMinMessageSize, sendBufferLowThreshold: 0}, tr.streamConfig)
+
+	_, err = newTransport(WithStreamWriteBuffer(0))
+	require.Error(t, err)
+	_, err = newTransport(WithMinMessageSize(maxMessageSize + 1))
+	require.Error(t, err)
+	_, err = newTransport(WithMinMessageSize(protoOverhead + varintOverhead))
+	require.Error(t, err)
+	_, err = newTransport(WithStreamWriteBuffer(1024), WithMinMessageSize(2048))
+	require.Error(t, err)
+	_, err = newTransport(WithSendBufferLowThreshold(-1))
+	require.Error(t, err)
+	_, err = newTransport(WithSendBufferLowThreshold(defaultMaxSendBuffer - defaultMinMessageSize + 1))
+	require.Error(t, err)
+
+	tr, err = newTransport(WithConnectionSendBuffer(1 << 16))
+	require.NoError(t, err)
+	require.Equal(t, 1<<16, tr.connectionSendBuffer)
+	_, err = newTransport(WithConnectionSendBuffer(0))
+	require.Error(t, err)
+	_, err = newTransport(WithConnectionSendBuffer(defaultMinMessageSize - 1))
+	require.Error(t, err)
+
+	var reported bool
+	tr, err = newTransport(WithAnomalyHandler(func(StreamAnomaly) { reported = true }))
+	require.NoError(t, err)
+	tr.streamConfig.anomalyHandler(StreamAnomaly{})
+	require.True(t, reported)
+}
+
 func TestTransportWebRTC_CanListenMultiple(t *testing.T) {
 	count := 3
 	tr, listeningPeer := getTransport(t, WithListenerMaxInFlightConnections(uint32(count)))
@@ -309,6 +401,63 @@ func TestTransportWebRTC_DialerCanCreateStreams(t *testing.T) {
 	}
 }
 
+func TestTransportWebRTC_OpenStreamWithOptions(t *testing.T) {
+	tr, listeningPeer := getTransport(t)
+	listener, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer listener.Close()
+
+	tr1, _ := getTransport(t)
+	conn, err := tr1.Dial(context.Background(), listener.Multiaddr(), listeningPeer)
+	require.NoError(t, err)
+	defer conn.Close()
+	lconn, err := listener.Accept()
+	require.NoError(t, err)
+	defer lconn.Close()
+	c, ok := conn.(StreamOpenerWithOptions)
+	require.True(t, ok)
+
+	for _, tc := range []struct {
+		name        string
+		opts        []StreamOption
+		channelType datachannel.ChannelType
+		param       uint32
+	}{
+		{"reliable", nil, datachannel.ChannelTypeReliable, 0},
+		{"unordered", []StreamOption{WithUnordered()}, datachannel.ChannelTypeReliableUnordered, 0},
+		{"max retransmits", []StreamOption{WithMaxRetransmits(3)}, datachannel.ChannelTypePartialReliableRexmit, 3},
+		{"unordered max lifetime", []StreamOption{WithUnordered(), WithMaxPacketLifeTime(250 * time.Millisecond)}, datachannel.ChannelTypePartialReliableTimedUnordered, 250},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			str, err := c.OpenStreamWithOptions(context.Background(), tc.opts...)
+			require.NoError(t, err)
+			defer str.Close()
+			_, err = str.Write([]byte("test"))
+			require.NoError(t, err)
+
+			lstr, err := lconn.AcceptStream()
+			require.NoError(t, err)
+			defer lstr.Close()
+			buf := make([]byte, 100)
+			n, err := lstr.Read(buf)
+			require.NoError(t, err)
+			require.Equal(t, "test", string(buf[:n]))
+
+			// both sides use the configured channel type
+			for _, s := range []network.MuxedStream{str, lstr} {
+				dc := s.(*stream).dataChannel
+				require.Equal(t, tc.channelType, dc.Config.ChannelType)
+				require.Equal(t, tc.param, dc.Config.ReliabilityParameter)
+			}
+		})
+	}
+
+	_, err = c.OpenStreamWithOptions(context.Background(), WithMaxRetransmits(3), WithMaxPacketLifeTime(time.Second))
+	require.Error(t, err)
+	_, err = c.OpenStreamWithOptions(context.Background(), WithMaxPacketLifeTime(time.Hour))
+	require.Error(t, err)
+}
+
 func TestTransportWebRTC_DialerCanCreateStreamsMultiple(t *testing.T) {
 	tr, listeningPeer := getTransport(t)
 	listenMultiaddr := ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct")
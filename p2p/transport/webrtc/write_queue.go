@@ -0,0 +1,128 @@
+package libp2pwebrtc
+
+// queuedWrite is the data of a write waiting for space on the send buffer.
+//
+// Writes that have to wait for space queue their remaining data on the stream. The first writer
+// that finds space once the send buffer drains sends a message with the data of all queued
+// writes, in FIFO order, up to the maximum message size. Under load, this packs the data of
+// many small concurrent writes into few large messages, instead of sending one message per
+// write. The data of a single write is always sent in order, and the data of different writes
+// is never interleaved.
+type queuedWrite struct {
+	// bufs[0][off:] is the data that wasn't put in a message yet
+	bufs [][]byte
+	off  int
+	// n is the number of bytes of the write that were sent
+	n int
+	// pending is the number of bytes put in the message that is currently being written
+	pending int
+	// done is closed once all data of the write was sent, or sending it failed
+	done chan struct{}
+	err  error
+}
+
+// consumed returns true if all data of the write was put in a message.
+func (w *queuedWrite) consumed() bool {
+	return len(w.bufs) == 0
+}
+
+// advance marks c bytes of the write as put in the current message.
+func (w *queuedWrite) advance(c int) {
+	w.off += c
+	w.pending += c
+	for len(w.bufs) > 0 && w.off == len(w.bufs[0]) {
+		w.bufs = w.bufs[1:]
+		w.off = 0
+	}
+}
+
+// isDone returns true once all data of the write was sent, or sending it failed.
+func (w *queuedWrite) isDone() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueWrite queues the data bufs[0][off:] and the following buffers of a write, that already
+// sent n bytes. bufs is copied, so that writes that never wait for space don't need to allocate
+// it on the heap.
+// It needs to be called while the mutex is locked.
+func (s *stream) queueWrite(bufs [][]byte, off, n int) *queuedWrite {
+	w := &queuedWrite{bufs: append([][]byte(nil), bufs...), off: off, n: n, done: make(chan struct{})}
+	w.advance(0)
+	s.writeQueue = append(s.writeQueue, w)
+	return w
+}
+
+// dequeueWrite removes w from the write queue, if it's still queued.
+// It needs to be called while the mutex is locked.
+func (s *stream) dequeueWrite(w *queuedWrite) {
+	for i, q := range s.writeQueue {
+		if q == w {
+			copy(s.writeQueue[i:], s.writeQueue[i+1:])
+			s.writeQueue[len(s.writeQueue)-1] = nil
+			s.writeQueue = s.writeQueue[:len(s.writeQueue)-1]
+			return
+		}
+	}
+}
+
+// queuedPayload returns the payload of the next message, with at most size bytes of queued
+// data. The data is copied to scratch, unless it's taken from a single buffer.
+// It needs to be called while the mutex is locked, and the write queue must not be empty.
+func (s *stream) queuedPayload(size int, scratch *[]byte) []byte {
+	head := s.writeQueue[0]
+	if b := head.bufs[0][head.off:]; len(b) >= size || (len(head.bufs) == 1 && len(s.writeQueue) == 1) {
+		// no need to copy if the message only contains data from a single buffer
+		if len(b) > size {
+			b = b[:size]
+		}
+		head.advance(len(b))
+		return b
+	}
+	if *scratch == nil {
+		*scratch = make([]byte, s.config.maxMessageSize)
+	}
+	payload := (*scratch)[:0]
+	for _, w := range s.writeQueue {
+		for len(payload) < size && !w.consumed() {
+			c := copy((*scratch)[len(payload):size], w.bufs[0][w.off:])
+			payload = (*scratch)[:len(payload)+c]
+			w.advance(c)
+		}
+		if len(payload) == size {
+			break
+		}
+	}
+	return payload
+}
+
+// completeQueuedWrites accounts for the data of the queued writes that was put in the last
+// message, after writing the message returned err. Writes whose data was sent completely, or
+// that were part of a message that failed, are removed from the queue.
+// It needs to be called while the mutex is locked.
+func (s *stream) completeQueuedWrites(err error) {
+	var completed int
+	for _, w := range s.writeQueue {
+		if w.pending == 0 {
+			break
+		}
+		if err == nil {
+			w.n += w.pending
+		}
+		w.pending = 0
+		if err != nil || w.consumed() {
+			w.err = err
+			close(w.done)
+			completed++
+		}
+	}
+	if completed > 0 {
+		n := copy(s.writeQueue, s.writeQueue[completed:])
+		clear(s.writeQueue[n:])
+		s.writeQueue = s.writeQueue[:n]
+	}
+}